@@ -1,23 +1,32 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"errors"
+	"flag"
 	"fmt"
 	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/middleware"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/router"
 	"httpfromtcp/internal/server"
+	"httpfromtcp/internal/logfile"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const port = 42069
+const shutdownTimeout = 30 * time.Second
+const maxBodySize = 1 << 20
 
 const status_400_html = `<html>
   <head>
@@ -29,12 +38,19 @@ const status_400_html = `<html>
   </body>
 </html>`
 
-func handle400(w *response.Writer) {
-	w.WriteStatusLine(response.Status400)
-	headers := response.GetDefaultHeaders(len(status_400_html))
-	headers.Override("Content-Type", "text/html")
-	w.WriteHeaders(headers)
-	w.WriteBody([]byte(status_400_html))
+func writeHTML(w *response.Writer, statusCode response.StatusCode, html string) error {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/html")
+	body, err := response.NewBodyWriter(w, statusCode, h)
+	if err != nil {
+		return err
+	}
+	io.WriteString(body, html)
+	return body.Close()
+}
+
+func handle400(w *response.Writer) error {
+	return writeHTML(w, response.Status400, status_400_html)
 }
 
 const status_500_html = `<html>
@@ -47,12 +63,8 @@ const status_500_html = `<html>
   </body>
 </html>`
 
-func handle500(w *response.Writer) {
-	w.WriteStatusLine(response.Status500)
-	headers := response.GetDefaultHeaders(len(status_500_html))
-	headers.Override("Content-Type", "text/html")
-	w.WriteHeaders(headers)
-	w.WriteBody([]byte(status_500_html))
+func handle500(w *response.Writer) error {
+	return writeHTML(w, response.Status500, status_500_html)
 }
 
 const status_200_html = `<html>
@@ -65,102 +77,161 @@ const status_200_html = `<html>
   </body>
 </html>`
 
-func handle200(w *response.Writer) {
-	w.WriteStatusLine(response.Status200)
-	headers := response.GetDefaultHeaders(len(status_200_html))
-	headers.Override("Content-Type", "text/html")
-	w.WriteHeaders(headers)
-	w.WriteBody([]byte(status_200_html))
+func handle200(w *response.Writer) error {
+	return writeHTML(w, response.Status200, status_200_html)
 }
 
-func handleVideo(w *response.Writer) {
-  fileName := "assets/vim.mp4"
-  video, err := os.ReadFile(fileName)
-  if err != nil {
-		fmt.Println("failed to read file:", fileName)
-    handle500(w)
-    return
-  }
+func handleVideo(w *response.Writer) error {
+	fileName := "assets/vim.mp4"
+	video, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("failed to open video: %w", err)
+	}
+	defer video.Close()
+	info, err := video.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat video: %w", err)
+	}
 	w.WriteStatusLine(response.Status200)
-	headers := response.GetDefaultHeaders(len(video))
-	headers.Override("Content-Type", "video/mp4")
-	w.WriteHeaders(headers)
-	w.WriteBody(video)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", fmt.Sprintf("%d", info.Size()))
+	h.Set("Content-Type", "video/mp4")
+	w.WriteHeaders(h)
+	// io.Copy hands the file to the writer, which sends it with sendfile
+	// without it passing through this process
+	_, err = io.Copy(w, video)
+	return err
 }
 
-
-func handleProxy(w *response.Writer, target string) {
+func handleProxy(w *response.Writer, target string) error {
 	resp, err := http.Get("https://httpbin.org" + target)
 	if err != nil {
-		fmt.Println("failed GET to httpbin:", err)
-		handle500(w)
-		return
+		return &server.HandlerError{StatusCode: response.Status502, Message: fmt.Sprintf("failed GET to httpbin: %v", err)}
 	}
 	defer resp.Body.Close()
 	w.WriteStatusLine(response.Status200)
 	trailers := response.GetDefaultHeaders(0)
-	trailers.Delete("Content-Length")
-	trailers.Override("Transfer-Encoding", "chunked")
-  trailers.Override("Trailer", "X-Content-Sha256, X-Content-Length")
+	trailers.Del("Content-Length")
+	trailers.Set("Transfer-Encoding", "chunked")
+  trailers.Set("Trailer", "X-Content-Sha256, X-Content-Length")
 	w.WriteHeaders(trailers)
 
   fullBody := []byte{}
 	buf := make([]byte, 1024)
 	for {
 		n, err := resp.Body.Read(buf)
-		fmt.Println("Read", n, "bytes")
 		if err != nil {
 			if !errors.Is(err, io.EOF) {
-				fmt.Println("failed reading body to buf:", err)
+				return fmt.Errorf("failed reading body from httpbin: %w", err)
 			}
 			break
 		}
 		w.WriteChunkedBody(buf[:n])
     fullBody = append(fullBody, buf[:n]...)
 	}
-	w.WriteChunkedBodyDone()
   bodyHash := sha256.Sum256(fullBody)
   trailers = headers.NewHeaders()
-  trailers.Override("X-Content-Sha256", fmt.Sprintf("%x", bodyHash))
-  trailers.Override("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-  err = w.WriteTrailers(trailers)
-  if err != nil {
-    fmt.Println("failed writing trailers:", err)
-  }
+  trailers.Set("X-Content-Sha256", fmt.Sprintf("%x", bodyHash))
+  trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
+  return w.WriteChunkedBodyDone(trailers)
 }
 
-func handler(w *response.Writer, req *request.Request) {
-	reqTarget := req.RequestLine.RequestTarget
-	if after, ok := strings.CutPrefix(reqTarget, "/httpbin"); ok {
-		httpbinTarget := after
-    handleProxy(w, httpbinTarget)
-		return
+func newRouter() *router.Router {
+	r := router.New()
+	r.Handle("GET", "/httpbin/*target", func(w *response.Writer, req *request.Request) error {
+		// keep the query string, httpbin endpoints take their options there
+		target := req.RequestLine.Target
+		httpbinTarget := strings.TrimPrefix(target.RawPath, "/httpbin")
+		if target.RawQuery != "" {
+			httpbinTarget += "?" + target.RawQuery
+		}
+		return handleProxy(w, httpbinTarget)
+	})
+	r.Handle("GET", "/yourproblem", func(w *response.Writer, req *request.Request) error {
+		return handle400(w)
+	})
+	r.Handle("GET", "/myproblem", func(w *response.Writer, req *request.Request) error {
+		return handle500(w)
+	})
+	r.Handle("GET", "/video", func(w *response.Writer, req *request.Request) error {
+		return handleVideo(w)
+	})
+	r.Handle("GET", "/*path", func(w *response.Writer, req *request.Request) error {
+		return handle200(w)
+	})
+	return r
+}
+
+// openAccessLog returns where the access log goes: standard output, or the
+// file at path rotated once it grows past maxSize.
+func openAccessLog(path string, maxSize int64, maxBackups int) (io.Writer, func() error, error) {
+	if path == "" {
+		return os.Stdout, func() error { return nil }, nil
+	}
+	file, err := logfile.Open(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, nil, err
 	}
-  if reqTarget == "/yourproblem" {
-		handle400(w)
-    return
-  }
-  if reqTarget == "/myproblem" {
-		handle500(w)
-    return
-  }
-  if reqTarget == "/video" {
-		handleVideo(w)
-    return
-  }
-  handle200(w)
+	return file, file.Close, nil
 }
 
 func main() {
-	server, err := server.Serve(port, handler)
+	accessLogPath := flag.String("access-log", "", "file to write the access log to, rotated by size (default standard output)")
+	logFormat := flag.String("log-format", "combined", "access log format: common, combined or json")
+	logMaxSize := flag.Int64("log-max-size", 100, "size in MiB past which the access log file is rotated")
+	logBackups := flag.Int("log-backups", 5, "number of rotated access log files to keep")
+	flag.Parse()
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	format, err := middleware.ParseLogFormat(*logFormat)
+	if err != nil {
+		logger.Error("Invalid flag", "error", err)
+		os.Exit(2)
+	}
+	accessLogOut, closeAccessLog, err := openAccessLog(*accessLogPath, *logMaxSize<<20, *logBackups)
+	if err != nil {
+		logger.Error("Error opening access log", "error", err)
+		os.Exit(1)
+	}
+	defer closeAccessLog()
+	accessLog := slog.New(middleware.NewAccessLogHandler(accessLogOut, format))
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		logger.Error("Error starting server", "error", err)
+		os.Exit(1)
 	}
-	defer server.Close()
-	log.Println("Server started on port", port)
+	router := newRouter()
+	handler := server.Chain(router.Serve,
+		middleware.RequestID(),
+		middleware.AccessLog(accessLog),
+		middleware.Recover(logger),
+		middleware.MaxBodySize(maxBodySize),
+	)
+	server := server.New(handler, server.Config{
+		Logger:       logger,
+		Methods:      router.Methods(),
+		ServerName:   "httpfromtcp",
+		ErrorHandler: server.WriteErrorHTML,
+		Timeouts: server.Timeouts{
+			ReadHeader: 10 * time.Second,
+			Read:       time.Minute,
+			Write:      5 * time.Minute,
+			Idle:       2 * time.Minute,
+		},
+	})
+	go server.Serve(listener)
+	logger.Info("Server started", "port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
-	log.Println("Server gracefully stopped")
+	logger.Info("Shutting down, waiting for requests in flight")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("Requests cut off at shutdown", "error", err)
+		return
+	}
+	logger.Info("Server gracefully stopped")
 }
@@ -36,11 +36,15 @@ func main() {
     fmt.Println("- Version:", request.RequestLine.HttpVersion)
 
     fmt.Println("Headers:")
-    for key, value := range request.Headers {
+    for key, value := range request.Headers.All() {
       fmt.Printf("- %s: %s\n", key, value)
     }
+    body, err := request.ReadBody()
+    if err != nil {
+      log.Fatalln("Failed to read body:", err.Error())
+    }
     fmt.Println("Body:")
-    fmt.Println(string(request.Body))
+    fmt.Println(string(body))
 
     fmt.Println("Connection to", conn.RemoteAddr(), "has been closed")
 	}
@@ -0,0 +1,18 @@
+package headers
+
+// Error is a malformed or unacceptable header section. StatusCode is the
+// HTTP status a server should answer the offending request with.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+var (
+	ErrMalformedFieldLine = &Error{StatusCode: 400, Message: "malformed header field line"}
+	ErrInvalidFieldName   = &Error{StatusCode: 400, Message: "invalid header field name"}
+	ErrHeaderTooLarge     = &Error{StatusCode: 431, Message: "request header fields too large"}
+)
@@ -3,18 +3,32 @@ package headers
 import (
 	"bytes"
 	"fmt"
+	"iter"
 	"strings"
 )
 
-type Headers map[string]string
+// Field is a single header field line.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Headers holds header fields in the order they were received or added.
+// Repeated fields are kept as separate lines rather than joined, since not
+// every field can be, Set-Cookie being the usual example. Field names are
+// case-insensitive: every method takes them in any case and stores them in
+// their CanonicalName form, which is also how they are sent.
+type Headers struct {
+	fields []Field
+}
 
-func NewHeaders() Headers {
-	return make(Headers)
+func NewHeaders() *Headers {
+	return &Headers{}
 }
 
 const crlf = "\r\n"
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
 	crlf_idx := bytes.Index(data, []byte(crlf))
 	// need to read more
 	if crlf_idx == -1 {
@@ -25,45 +39,174 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 		return len(crlf), true, nil
 	}
 	data_string := string(data[:crlf_idx])
+	// a lone CR or LF is read as a line break by some parsers and not by
+	// others, a way to smuggle a header past one of them
+	if strings.ContainsAny(data_string, "\r\n") {
+		return 0, false, fmt.Errorf("%w: bare CR or LF in %q", ErrMalformedFieldLine, data_string)
+	}
+	// obs-fold continues the previous field for some parsers and starts a new
+	// one for others, RFC 9112 lets a server reject it
+	if data_string[0] == ' ' || data_string[0] == '\t' {
+		return 0, false, fmt.Errorf("%w: line folding or leading whitespace in %q", ErrMalformedFieldLine, data_string)
+	}
 	key, val, found := strings.Cut(data_string, ":")
 	if !found {
-		return 0, false, fmt.Errorf("invalid header format: missing : in %s", data_string)
+		return 0, false, fmt.Errorf("%w: missing : in %s", ErrMalformedFieldLine, data_string)
+	}
+	if key != strings.TrimRight(key, " \t") {
+		return 0, false, fmt.Errorf("%w: trailing whitespace in header key %q", ErrMalformedFieldLine, key)
+	}
+	if !IsToken(key) {
+		return 0, false, fmt.Errorf("%w '%s': contains invalid character", ErrInvalidFieldName, key)
+	}
+	val = strings.Trim(val, " \t")
+	if !isFieldValue(val) {
+		return 0, false, fmt.Errorf("%w: control character in value of %s", ErrMalformedFieldLine, key)
+	}
+
+	h.Add(key, val)
+	return crlf_idx + len(crlf), false, nil
+}
+
+// isFieldValue reports whether value is free of the control characters,
+// other than horizontal tab, that RFC 9110 leaves out of field values.
+func isFieldValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
 	}
-	if key != strings.TrimRight(key, " ") {
-		return 0, false, fmt.Errorf("invalid header format: trailing whitespace in header key %s", key)
+	return true
+}
+
+// IsToken reports whether s is a non-empty RFC 9110 token, the syntax of
+// field names, methods and chunk extension names.
+func IsToken(s string) bool {
+	if s == "" {
+		return false
 	}
-	key = strings.TrimSpace(key)
-	key_has_invalid_char := strings.ContainsFunc(key, func(r rune) bool {
+	return !strings.ContainsFunc(s, func(r rune) bool {
 		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
 			return false
 		}
 		return !strings.ContainsRune("!#$%&'*+-.^_`|~", r)
 	})
-	if key_has_invalid_char {
-		return 0, false, fmt.Errorf("invalid header key '%s': contains invalid character", key)
+}
+
+// CanonicalName returns name with its first letter and every letter after a
+// hyphen in upper case and the rest in lower case, as in Content-Type. Names
+// that are not valid tokens are returned unchanged.
+func CanonicalName(name string) string {
+	if !IsToken(name) {
+		return name
+	}
+	upper := true
+	canonical := []byte(name)
+	for i, c := range canonical {
+		switch {
+		case upper && c >= 'a' && c <= 'z':
+			canonical[i] = c - 'a' + 'A'
+		case !upper && c >= 'A' && c <= 'Z':
+			canonical[i] = c - 'A' + 'a'
+		}
+		upper = c == '-'
 	}
-	key = strings.ToLower(key)
-	val = strings.TrimSpace(val)
+	return string(canonical)
+}
 
-  existing_val, exists := h[key]
-	if exists {
-    h[key] = fmt.Sprintf("%s, %s", existing_val, val)
-	} else {
-		h[key] = val
+// Get returns the value of the first field named key.
+func (h *Headers) Get(key string) (string, bool) {
+	key = CanonicalName(key)
+	for _, field := range h.fields {
+		if field.Name == key {
+			return field.Value, true
+		}
 	}
-	return crlf_idx + len(crlf), false, nil
+	return "", false
 }
 
-func (h Headers) Get(key string) (string, bool) {
-  key = strings.ToLower(key)
-  v, ok := h[key]
-  return v, ok
+// Values returns the values of all fields named key, in order.
+func (h *Headers) Values(key string) []string {
+	key = CanonicalName(key)
+	var values []string
+	for _, field := range h.fields {
+		if field.Name == key {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+// HasToken reports whether any field named key holds token in its comma
+// separated list value.
+func (h *Headers) HasToken(key, token string) bool {
+	for _, value := range h.Values(key) {
+		if ContainsToken(value, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add appends a field, keeping any already present with the same name.
+func (h *Headers) Add(key, val string) {
+	h.fields = append(h.fields, Field{Name: CanonicalName(key), Value: val})
+}
+
+// Set replaces all fields named key with a single one holding val, in the
+// place of the first of them.
+func (h *Headers) Set(key, val string) {
+	key = CanonicalName(key)
+	for i, field := range h.fields {
+		if field.Name == key {
+			h.fields[i] = Field{Name: key, Value: val}
+			h.fields = append(h.fields[:i+1], deleteFields(h.fields[i+1:], key)...)
+			return
+		}
+	}
+	h.Add(key, val)
 }
 
-func (h Headers) Override(key, val string) {
-  h[key] = val
+// Del removes all fields named key.
+func (h *Headers) Del(key string) {
+	h.fields = deleteFields(h.fields, CanonicalName(key))
 }
 
-func (h Headers) Delete(key string) {
-  delete(h, key)
+// deleteFields removes the fields named with the canonical key.
+func deleteFields(fields []Field, key string) []Field {
+	kept := fields[:0]
+	for _, field := range fields {
+		if field.Name != key {
+			kept = append(kept, field)
+		}
+	}
+	clear(fields[len(kept):])
+	return kept
+}
+
+// Len returns the number of field lines.
+func (h *Headers) Len() int {
+	return len(h.fields)
+}
+
+// All iterates over the field lines in order.
+func (h *Headers) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		for _, field := range h.fields {
+			if !yield(field.Name, field.Value) {
+				return
+			}
+		}
+	}
+}
+
+// ContainsToken reports whether the comma separated field value list contains
+// token, compared case-insensitively as in Connection: keep-alive, close.
+func ContainsToken(list, token string) bool {
+	for elem := range strings.SplitSeq(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(elem), token) {
+			return true
+		}
+	}
+	return false
 }
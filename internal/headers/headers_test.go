@@ -7,6 +7,12 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// get returns the value of the first field named key, "" if there is none
+func get(h *Headers, key string) string {
+	v, _ := h.Get(key)
+	return v
+}
+
 func TestHeadersParse(t *testing.T) {
 	// Test: Valid single header
 	headers := NewHeaders()
@@ -14,28 +20,29 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
 	// Test: Valid single header with extra whitespace
 	headers = NewHeaders()
-	data = []byte("          HOST:      localhost:42069      \r\n\r\n")
+	data = []byte("HOST:      localhost:42069 \t    \r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, 44, n)
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
+	assert.Equal(t, 34, n)
 	assert.False(t, done)
 
 	// Test: Valid 2 headers with existing headers
-	headers = map[string]string{"host": "localhost:42069"}
+	headers = NewHeaders()
+	headers.Add("host", "localhost:42069")
 	data = []byte("another-header: something-something\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "something-something", headers["another-header"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
+	assert.Equal(t, "something-something", get(headers, "another-header"))
 	assert.Equal(t, 37, n)
 	assert.False(t, done)
 
@@ -45,17 +52,18 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Empty(t, headers)
+	assert.Equal(t, 0, headers.Len())
 	assert.Equal(t, 2, n)
 	assert.True(t, done)
 
 	// Test: Valid header key with multiple values
-	headers = map[string]string{"host": "localhost:42069"}
+	headers = NewHeaders()
+	headers.Add("host", "localhost:42069")
   data = []byte("Host: hostlocal:69420\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-  assert.Equal(t, "localhost:42069, hostlocal:69420", headers["host"])
+	assert.Equal(t, []string{"localhost:42069", "hostlocal:69420"}, headers.Values("host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
@@ -64,15 +72,32 @@ func TestHeadersParse(t *testing.T) {
 	headers = NewHeaders()
 	data = []byte("       Host : localhost:42069       \r\n\r\n")
 	n, done, err = headers.Parse(data)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrMalformedFieldLine)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	// Test: Invalid tab before the colon
+	headers = NewHeaders()
+	data = []byte("Host\t: localhost:42069\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrMalformedFieldLine)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 
+	// Test: Invalid leading whitespace, which is also how obs-fold starts
+	for _, line := range []string{"   Host: localhost:42069\r\n\r\n", "\tHost: localhost:42069\r\n\r\n"} {
+		headers = NewHeaders()
+		n, done, err = headers.Parse([]byte(line))
+		require.ErrorIs(t, err, ErrMalformedFieldLine)
+		assert.Equal(t, 0, n)
+		assert.False(t, done)
+	}
+
 	// Test: Invalid header key character
 	headers = NewHeaders()
 	data = []byte("H©st: localhost:42069\r\n\r\n")
 	n, done, err = headers.Parse(data)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrInvalidFieldName)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 
@@ -80,7 +105,68 @@ func TestHeadersParse(t *testing.T) {
 	headers = NewHeaders()
 	data = []byte("Host localhost:42069\r\n\r\n")
 	n, done, err = headers.Parse(data)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrInvalidFieldName)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 }
+
+func TestHeadersFields(t *testing.T) {
+	// Test: Repeated fields keep their own lines and order
+	headers := NewHeaders()
+	headers.Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+	headers.Add("Content-Type", "text/plain")
+	headers.Add("set-cookie", "b=2")
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2"}, headers.Values("SET-COOKIE"))
+	assert.Equal(t, "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", get(headers, "Set-Cookie"))
+	assert.Equal(t, 3, headers.Len())
+
+	// Test: Set replaces every line of a field in place of the first
+	headers.Set("SET-COOKIE", "c=3")
+	var fields []string
+	for name, value := range headers.All() {
+		fields = append(fields, name+": "+value)
+	}
+	assert.Equal(t, []string{"Set-Cookie: c=3", "Content-Type: text/plain"}, fields)
+
+	// Test: Set on a missing field appends it
+	headers.Set("X-New", "1")
+	assert.Equal(t, "1", get(headers, "x-new"))
+	assert.Equal(t, 3, headers.Len())
+
+	// Test: Del removes every line of a field
+	headers.Add("x-new", "2")
+	headers.Del("X-NEW")
+	_, ok := headers.Get("X-New")
+	assert.False(t, ok)
+	assert.Equal(t, 2, headers.Len())
+
+	// Test: Tokens are found in any line of a list field
+	headers.Add("Connection", "keep-alive")
+	headers.Add("Connection", "Upgrade, Close")
+	assert.True(t, headers.HasToken("connection", "close"))
+	assert.False(t, headers.HasToken("connection", "upgrade-insecure"))
+}
+
+func TestCanonicalName(t *testing.T) {
+	// Test: Names are canonicalized on the way in, whatever their case
+	headers := NewHeaders()
+	_, _, err := headers.Parse([]byte("cONTENT-lENGTH: 5\r\n"))
+	require.NoError(t, err)
+	headers.Set("content-type", "text/plain")
+	headers.Add("X-REQUEST-ID", "abc")
+	var names []string
+	for name := range headers.All() {
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{"Content-Length", "Content-Type", "X-Request-Id"}, names)
+
+	// Test: Mutators find fields whatever case they are given in
+	headers.Del("CONTENT-LENGTH")
+	headers.Set("x-request-id", "def")
+	assert.Equal(t, 2, headers.Len())
+	assert.Equal(t, []string{"def"}, headers.Values("X-Request-ID"))
+
+	assert.Equal(t, "Www-Authenticate", CanonicalName("www-authenticate"))
+	assert.Equal(t, "Te", CanonicalName("TE"))
+	assert.Equal(t, "bad name", CanonicalName("bad name"))
+}
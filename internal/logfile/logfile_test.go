@@ -0,0 +1,68 @@
+package logfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readFile(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	require.NoError(t, os.WriteFile(path, []byte("old\n"), 0o644))
+	f, err := Open(path, 10, 2)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Test: Writes append to the existing file while they fit
+	_, err = f.Write([]byte("one\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "old\none\n", readFile(t, path))
+
+	// Test: A write going past the size starts a new file
+	_, err = f.Write([]byte("three\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "three\n", readFile(t, path))
+	assert.Equal(t, "old\none\n", readFile(t, path+".1"))
+
+	// Test: Backups shift along and the oldest is dropped
+	for _, line := range []string{"four\n", "five\n", "six\n"} {
+		_, err = f.Write([]byte(line + "xxxx"))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "six\nxxxx", readFile(t, path))
+	assert.Equal(t, "five\nxxxx", readFile(t, path+".1"))
+	assert.Equal(t, "four\nxxxx", readFile(t, path+".2"))
+	assert.NoFileExists(t, path+".3")
+
+	// Test: A write larger than the size still goes in whole
+	_, err = f.Write([]byte("a line longer than ten bytes\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "a line longer than ten bytes\n", readFile(t, path))
+
+	// Test: Writes after Close fail
+	require.NoError(t, f.Close())
+	_, err = f.Write([]byte("late\n"))
+	assert.ErrorIs(t, err, os.ErrClosed)
+}
+
+func TestRotateWithoutBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := Open(path, 5, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write([]byte("1234\n"))
+	require.NoError(t, err)
+	_, err = f.Write([]byte("5678\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "5678\n", readFile(t, path))
+	assert.NoFileExists(t, path+".1")
+}
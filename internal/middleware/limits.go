@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"strconv"
+)
+
+// MaxBodySize rejects request bodies over n bytes with 413, tighter than the
+// server wide request.Limits for the handlers it wraps. A Content-Length over
+// n is rejected before the handler runs, a chunked body once reading it goes
+// past n, Body then failing with a *server.HandlerError the handler can
+// return as is. The connection is closed after such a response rather than
+// reading the rest of the body.
+func MaxBodySize(n int64) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) error {
+			if value, ok := req.Headers.Get("Content-Length"); ok {
+				// the parser has already checked it is a number
+				if length, err := strconv.ParseInt(value, 10, 64); err == nil && length > n {
+					w.SetClose()
+					return bodyTooLarge(n)
+				}
+			}
+			req.Body = &maxBodyReader{body: req.Body, w: w, remaining: n, limit: n}
+			return next(w, req)
+		}
+	}
+}
+
+func bodyTooLarge(n int64) *server.HandlerError {
+	return &server.HandlerError{
+		StatusCode: response.Status413,
+		Message:    fmt.Sprintf("request body over %d bytes", n),
+	}
+}
+
+type maxBodyReader struct {
+	body      io.ReadCloser
+	w         *response.Writer
+	remaining int64
+	limit     int64
+	err       error
+}
+
+func (r *maxBodyReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	// read one byte past the limit to tell a body of exactly n bytes from a
+	// longer one
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.body.Read(p)
+	if int64(n) > r.remaining {
+		n = int(r.remaining)
+		r.err = bodyTooLarge(r.limit)
+		r.w.SetClose()
+		err = r.err
+	}
+	r.remaining -= int64(n)
+	return n, err
+}
+
+func (r *maxBodyReader) Close() error {
+	return r.body.Close()
+}
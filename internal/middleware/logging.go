@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"log/slog"
+	"time"
+)
+
+// AccessLog logs a record to logger for every request once it is answered,
+// with the client address, method, target, protocol, status code, body
+// bytes sent, time taken, user agent and referer, along with the request ID
+// if RequestID runs before it. The output format is up to the handler of
+// logger, NewAccessLogHandler writes the usual ones. The record is logged
+// when the server finishes the response, so the status is that of the error
+// response the server writes when the handler fails, and 0 if the client
+// went away before any response could be sent.
+func AccessLog(logger *slog.Logger) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) error {
+			start := time.Now()
+			w.OnFinish(func() {
+				userAgent, _ := req.Headers.Get("User-Agent")
+				referer, _ := req.Headers.Get("Referer")
+				line := req.RequestLine
+				attrs := []slog.Attr{
+					slog.String("remote_addr", req.RemoteAddr),
+					slog.String("method", line.Method),
+					slog.String("target", line.RequestTarget),
+					slog.String("proto", "HTTP/"+line.HttpVersion),
+					slog.Int("status", int(w.StatusCode())),
+					slog.Int64("bytes", w.BodyBytes()),
+					slog.Duration("duration", time.Since(start)),
+					slog.String("user_agent", userAgent),
+					slog.String("referer", referer),
+				}
+				if id := RequestIDFrom(req); id != "" {
+					attrs = append(attrs, slog.String("request_id", id))
+				}
+				logger.LogAttrs(req.Context(), slog.LevelInfo, "request", attrs...)
+			})
+			return next(w, req)
+		}
+	}
+}
@@ -0,0 +1,4 @@
+// Package middleware provides server.Middleware for concerns most servers
+// share: request IDs, access logging, panic recovery, timeouts, body size
+// limits and client addresses behind proxies. Combine them with server.Chain.
+package middleware
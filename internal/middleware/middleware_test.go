@@ -0,0 +1,307 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs raw through handler and returns the writer for inspection, the
+// error the handler returned and the parsed response, nil if none was written
+func serve(t *testing.T, handler server.Handler, raw string) (*response.Writer, error, *http.Response) {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = "192.0.2.1:51234"
+	var out bytes.Buffer
+	w := response.NewWriter(&out)
+	w.SetRequestMethod(req.RequestLine.Method)
+	handlerErr := handler(w, req)
+	require.NoError(t, w.Flush())
+	w.Finish()
+	if out.Len() == 0 {
+		return w, handlerErr, nil
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(&out), nil)
+	require.NoError(t, err)
+	return w, handlerErr, resp
+}
+
+func ok(w *response.Writer, req *request.Request) error {
+	body := []byte("ok\n")
+	w.WriteStatusLine(response.Status200)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	_, err := w.WriteBody(body)
+	return err
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := server.Chain(func(w *response.Writer, req *request.Request) error {
+		seen = RequestIDFrom(req)
+		return ok(w, req)
+	}, RequestID())
+
+	// Test: A new ID is made up and sent back
+	_, err, resp := serve(t, handler, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Len(t, seen, 32)
+	assert.Equal(t, seen, resp.Header.Get("X-Request-Id"))
+
+	// Test: The ID of an upstream proxy is kept
+	_, err, resp = serve(t, handler, "GET / HTTP/1.1\r\nX-Request-Id: abc-123\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "abc-123", seen)
+	assert.Equal(t, "abc-123", resp.Header.Get("X-Request-Id"))
+
+	// Test: A malformed ID is replaced
+	_, err, resp = serve(t, handler, "GET / HTTP/1.1\r\nX-Request-Id: a b\"c\r\n\r\n")
+	require.NoError(t, err)
+	assert.Len(t, seen, 32)
+	assert.Equal(t, seen, resp.Header.Get("X-Request-Id"))
+
+	// Test: No ID outside of the middleware
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "", RequestIDFrom(req))
+}
+
+func TestAccessLog(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(NewAccessLogHandler(&logs, LogCommon))
+
+	// Test: Status and bytes of a written response
+	_, err, _ := serve(t, server.Chain(ok, AccessLog(logger)), "GET /a?b=c HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Regexp(t, `^192\.0\.2\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /a\?b=c HTTP/1\.1" 200 3\n$`, logs.String())
+
+	// Test: Status and bytes of the error responses the server writes
+	var serverLogs lockedBuffer
+	logger = slog.New(NewAccessLogHandler(&serverLogs, LogCommon))
+	failing := func(w *response.Writer, req *request.Request) error {
+		if req.RequestLine.Target.Path == "/missing" {
+			return &server.HandlerError{StatusCode: response.Status404, Message: "no such thing"}
+		}
+		_, err := req.ReadBody()
+		return err
+	}
+	srv := server.New(server.Chain(failing, AccessLog(logger)), server.Config{
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Timeouts: server.Timeouts{Read: 50 * time.Millisecond},
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(listener)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	_, err = conn.Write([]byte("GET /missing HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	io.Copy(io.Discard, resp.Body)
+	// a body that never arrives times out, answered 408 by the server
+	_, err = conn.Write([]byte("POST /slow HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc"))
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 408, resp.StatusCode)
+	io.Copy(io.Discard, resp.Body)
+	// the record is logged once the response has been sent
+	require.Eventually(t, func() bool { return strings.Count(serverLogs.String(), "\n") == 2 }, time.Second, 10*time.Millisecond)
+	lines := strings.Split(strings.TrimSpace(serverLogs.String()), "\n")
+	assert.Contains(t, lines[0], `"GET /missing HTTP/1.1" 404 14`)
+	assert.Contains(t, lines[1], `"POST /slow HTTP/1.1" 408 `)
+
+	// Test: HEAD sends no body bytes
+	logger = slog.New(NewAccessLogHandler(&logs, LogCommon))
+	logs.Reset()
+	_, err, _ = serve(t, server.Chain(ok, AccessLog(logger)), "HEAD / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Contains(t, logs.String(), `"HEAD / HTTP/1.1" 200 -`)
+
+	// Test: Combined format adds the referer and escaped user agent
+	logs.Reset()
+	logger = slog.New(NewAccessLogHandler(&logs, LogCombined))
+	_, err, _ = serve(t, server.Chain(ok, AccessLog(logger)), "GET / HTTP/1.1\r\nUser-Agent: say \"hi\"\r\n\r\n")
+	require.NoError(t, err)
+	assert.Contains(t, logs.String(), `"GET / HTTP/1.1" 200 3 "-" "say \"hi\""`+"\n")
+
+	// Test: Quotes in the target cannot end the quoted request line early
+	logs.Reset()
+	_, err, _ = serve(t, server.Chain(ok, AccessLog(logger)), "GET /a\"b\\ HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Contains(t, logs.String(), `"GET /a\"b\\ HTTP/1.1" 200 3 `)
+
+	// Test: JSON format has every attribute, the request ID included
+	logs.Reset()
+	logger = slog.New(NewAccessLogHandler(&logs, LogJSON))
+	_, err, _ = serve(t, server.Chain(ok, RequestID(), AccessLog(logger)),
+		"POST /x HTTP/1.1\r\nUser-Agent: curl/8.0\r\nX-Request-Id: abc\r\n\r\n")
+	require.NoError(t, err)
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(logs.Bytes(), &record))
+	assert.Equal(t, "request", record["msg"])
+	assert.Equal(t, "192.0.2.1:51234", record["remote_addr"])
+	assert.Equal(t, "POST", record["method"])
+	assert.Equal(t, "/x", record["target"])
+	assert.Equal(t, "HTTP/1.1", record["proto"])
+	assert.Equal(t, 200.0, record["status"])
+	assert.Equal(t, 3.0, record["bytes"])
+	assert.Equal(t, "curl/8.0", record["user_agent"])
+	assert.Equal(t, "abc", record["request_id"])
+	assert.Contains(t, record, "duration")
+}
+
+// lockedBuffer collects the log output of a server running in other
+// goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestParseLogFormat(t *testing.T) {
+	format, err := ParseLogFormat("Combined")
+	require.NoError(t, err)
+	assert.Equal(t, LogCombined, format)
+	_, err = ParseLogFormat("xml")
+	assert.Error(t, err)
+}
+
+func TestRecover(t *testing.T) {
+	var logs bytes.Buffer
+	panicking := func(w *response.Writer, req *request.Request) error {
+		panic("boom")
+	}
+	w, err, resp := serve(t, server.Chain(panicking, Recover(slog.New(slog.NewTextHandler(&logs, nil)))), "GET / HTTP/1.1\r\n\r\n")
+	assert.Nil(t, resp)
+	var handlerErr *server.HandlerError
+	require.ErrorAs(t, err, &handlerErr)
+	assert.Equal(t, response.Status500, handlerErr.StatusCode)
+	assert.True(t, w.Closing())
+	assert.Contains(t, logs.String(), "remote_addr=192.0.2.1:51234 panic=boom")
+	assert.Contains(t, logs.String(), "goroutine")
+}
+
+func TestTimeout(t *testing.T) {
+	slow := func(w *response.Writer, req *request.Request) error {
+		select {
+		case <-req.Context().Done():
+			return req.Context().Err()
+		case <-time.After(time.Second):
+			return ok(w, req)
+		}
+	}
+
+	// Test: A handler that gives up is answered with 503
+	_, err, resp := serve(t, server.Chain(slow, Timeout(10*time.Millisecond)), "GET / HTTP/1.1\r\n\r\n")
+	assert.Nil(t, resp)
+	var handlerErr *server.HandlerError
+	require.ErrorAs(t, err, &handlerErr)
+	assert.Equal(t, response.Status503, handlerErr.StatusCode)
+
+	// Test: A handler in time is left alone
+	_, err, resp = serve(t, server.Chain(ok, Timeout(time.Second)), "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestMaxBodySize(t *testing.T) {
+	echo := func(w *response.Writer, req *request.Request) error {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		w.WriteStatusLine(response.Status200)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		_, err = w.WriteBody(body)
+		return err
+	}
+	handler := server.Chain(echo, MaxBodySize(5))
+	var handlerErr *server.HandlerError
+
+	// Test: A body within the limit
+	_, err, resp := serve(t, handler, "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello")
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: A Content-Length over the limit
+	w, err, resp := serve(t, handler, "POST / HTTP/1.1\r\nContent-Length: 6\r\n\r\nhello!")
+	assert.Nil(t, resp)
+	require.ErrorAs(t, err, &handlerErr)
+	assert.Equal(t, response.Status413, handlerErr.StatusCode)
+	assert.True(t, w.Closing())
+
+	// Test: A chunked body of exactly the limit
+	_, err, resp = serve(t, handler, "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhel\r\n2\r\nlo\r\n0\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: A chunked body going over the limit
+	w, err, resp = serve(t, handler, "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhel\r\n3\r\nlo!\r\n0\r\n\r\n")
+	assert.Nil(t, resp)
+	require.ErrorAs(t, err, &handlerErr)
+	assert.Equal(t, response.Status413, handlerErr.StatusCode)
+	assert.True(t, w.Closing())
+}
+
+func TestRealIP(t *testing.T) {
+	var remoteAddr string
+	record := func(w *response.Writer, req *request.Request) error {
+		remoteAddr = req.RemoteAddr
+		return ok(w, req)
+	}
+	trusted := server.Chain(record, RealIP(netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("10.0.0.0/8")))
+	untrusted := server.Chain(record, RealIP(netip.MustParsePrefix("10.0.0.0/8")))
+
+	tests := []struct {
+		name       string
+		handler    server.Handler
+		headers    string
+		remoteAddr string
+	}{
+		{"no headers", trusted, "", "192.0.2.1:51234"},
+		{"forwarded for", trusted, "X-Forwarded-For: 203.0.113.7\r\n", "203.0.113.7"},
+		{"rightmost untrusted hop", trusted, "X-Forwarded-For: 198.51.100.1, 203.0.113.7, 10.1.2.3\r\n", "203.0.113.7"},
+		{"several fields", trusted, "X-Forwarded-For: 203.0.113.7\r\nX-Forwarded-For: 10.1.2.3\r\n", "203.0.113.7"},
+		{"ipv6", trusted, "X-Forwarded-For: 2001:db8::1\r\n", "2001:db8::1"},
+		{"real ip", trusted, "X-Real-Ip: 203.0.113.7\r\n", "203.0.113.7"},
+		{"malformed hop", trusted, "X-Forwarded-For: 203.0.113.7, bogus\r\n", "192.0.2.1:51234"},
+		{"untrusted peer", untrusted, "X-Forwarded-For: 203.0.113.7\r\n", "192.0.2.1:51234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err, _ := serve(t, tt.handler, "GET / HTTP/1.1\r\n"+tt.headers+"\r\n")
+			require.NoError(t, err)
+			assert.Equal(t, tt.remoteAddr, remoteAddr)
+		})
+	}
+}
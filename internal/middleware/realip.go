@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// RealIP replaces the RemoteAddr of requests coming from a proxy in trusted
+// with the address of the client the proxy got them from. It is taken from
+// X-Forwarded-For, as the rightmost address that is not itself a trusted
+// proxy, or else from X-Real-Ip. Requests from anywhere else are left alone,
+// as anyone can send these headers.
+func RealIP(trusted ...netip.Prefix) server.Middleware {
+	isTrusted := func(addr netip.Addr) bool {
+		for _, prefix := range trusted {
+			if prefix.Contains(addr.Unmap()) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) error {
+			if peer, ok := parseIP(req.RemoteAddr); ok && isTrusted(peer) {
+				if client, ok := forwardedFor(req, isTrusted); ok {
+					req.RemoteAddr = client.String()
+				}
+			}
+			return next(w, req)
+		}
+	}
+}
+
+// forwardedFor returns the client address the proxies in front of the server
+// report, going through X-Forwarded-For from the right past trusted ones.
+func forwardedFor(req *request.Request, isTrusted func(netip.Addr) bool) (netip.Addr, bool) {
+	// a proxy may add its own field rather than append to the last one
+	forwarded := req.Headers.Values("X-Forwarded-For")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hops := strings.Split(forwarded[i], ",")
+		for j := len(hops) - 1; j >= 0; j-- {
+			addr, ok := parseIP(strings.TrimSpace(hops[j]))
+			if !ok {
+				// nothing left of a malformed hop can be trusted
+				return netip.Addr{}, false
+			}
+			if !isTrusted(addr) {
+				return addr, true
+			}
+		}
+	}
+	if realIP, ok := req.Headers.Get("X-Real-Ip"); ok {
+		return parseIP(strings.TrimSpace(realIP))
+	}
+	return netip.Addr{}, false
+}
+
+// parseIP parses an IP address, with or without a port.
+func parseIP(s string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"log/slog"
+	"runtime/debug"
+)
+
+// Recover turns a panic in the handler into a 500, logging it to logger along
+// with its stack. The connection is closed after the response, as the state
+// the panic left it in is unknown. The server recovers panics on its own,
+// Recover lets middleware outside of it, such as AccessLog, see them as
+// errors.
+func Recover(logger *slog.Logger) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) (err error) {
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				logger.Error("panic serving request", "remote_addr", req.RemoteAddr, "panic", p, "stack", string(debug.Stack()))
+				w.SetClose()
+				err = &server.HandlerError{
+					StatusCode: response.Status500,
+					Message:    response.StatusText(response.Status500),
+				}
+			}()
+			return next(w, req)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// RequestIDHeader carries the ID of a request, both ways.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the IDs taken from clients, which end up in logs.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestID gives each request an ID, which handlers get with
+// RequestIDFrom and which is sent back in the X-Request-Id header of the
+// response. An ID the client or a proxy in front already sent is kept if it
+// is made of letters, digits, '-', '_' and '.', otherwise a random one is
+// made up.
+func RequestID() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) error {
+			id, ok := req.Headers.Get(RequestIDHeader)
+			if !ok || !validRequestID(id) {
+				id = newRequestID()
+			}
+			w.OnHeaders(func(statusCode response.StatusCode, h *headers.Headers) {
+				h.Set(RequestIDHeader, id)
+			})
+			return next(w, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+		}
+	}
+}
+
+// RequestIDFrom returns the ID RequestID gave req, or the empty string if it
+// went through no RequestID middleware.
+func RequestIDFrom(req *request.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range []byte(id) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns 16 random bytes in hex.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"time"
+)
+
+// Timeout cancels the context of requests the handler has not answered
+// within d. Handlers have to watch req.Context() for it to have any effect.
+// A handler that gives up before starting its response is answered with 503,
+// one that has started it has the connection closed by the server.
+func Timeout(d time.Duration) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) error {
+			ctx, cancel := context.WithTimeout(req.Context(), d)
+			defer cancel()
+			err := next(w, req.WithContext(ctx))
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) && !w.Started() {
+				return &server.HandlerError{StatusCode: response.Status503, Message: "request timed out"}
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errBodyClosed = errors.New("read on closed request body")
+
+// body reads a request body from the connection as the parser walks through
+// its Content-Length or chunked framing.
+type body struct {
+	request *Request
+	source  *Reader
+	closed  bool
+	err     error
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, errBodyClosed
+	}
+	return b.read(p)
+}
+
+// Close stops the handler from reading any further. The unread rest of the
+// body is still discarded before the next request on the connection.
+func (b *body) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (b *body) read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for b.request.State != request_done {
+		n, err := b.source.parse(b.request, p)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = fmt.Errorf("%w: %w in the body", ErrIncompleteRequest, io.ErrUnexpectedEOF)
+			}
+			b.err = err
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+	b.err = io.EOF
+	return 0, io.EOF
+}
+
+// BodyError returns the error reading the body failed with, nil if it has
+// not failed so far.
+func (r *Request) BodyError() error {
+	if errors.Is(r.body.err, io.EOF) {
+		return nil
+	}
+	return r.body.err
+}
+
+// DiscardBody reads and drops what is left unread of the body, even if Body
+// has been closed or replaced.
+func (r *Request) DiscardBody() error {
+	return r.body.discard()
+}
+
+func (b *body) discard() error {
+	buf := make([]byte, 4096)
+	for {
+		_, err := b.read(buf)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReadBody reads the whole body into memory. It is meant for small bodies,
+// larger ones should be streamed from Body instead.
+func (r *Request) ReadBody() ([]byte, error) {
+	defer r.Body.Close()
+	return io.ReadAll(r.Body)
+}
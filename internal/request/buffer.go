@@ -0,0 +1,94 @@
+package request
+
+import (
+	"errors"
+	"io"
+)
+
+// initialBufferSize is what a connection's buffer starts at, enough for most
+// requests' heads. It only grows past that for a longer line.
+const initialBufferSize = 4 << 10
+
+// maxEmptyReads is how many reads returning nothing in a row a buffer puts
+// up with before giving up on the source.
+const maxEmptyReads = 100
+
+var errBufferFull = errors.New("buffer full")
+
+// buffer holds bytes read from a connection until the parser is done with
+// them. Unlike a bufio.Reader it does not allocate its maximum size up front:
+// it starts at initialBufferSize and grows, up to max, only while a line it
+// holds is still within the limits, so an idle connection costs little
+// whatever the limits are. Once drained it goes back to its initial size.
+type buffer struct {
+	src  io.Reader
+	buf  []byte
+	r, w int
+	max  int
+}
+
+func newBuffer(src io.Reader, max int) *buffer {
+	return &buffer{src: src, max: max}
+}
+
+// buffered returns how many bytes can be peeked without reading.
+func (b *buffer) buffered() int {
+	return b.w - b.r
+}
+
+// peek returns the next n bytes without consuming them, reading from the
+// source until that many are buffered. It returns fewer along with the error
+// reading failed with, or errBufferFull if n is over the maximum size.
+func (b *buffer) peek(n int) ([]byte, error) {
+	var err error
+	if n > b.max {
+		n, err = b.max, errBufferFull
+	}
+	empty_reads := 0
+	for b.buffered() < n {
+		b.makeRoom(n)
+		read, read_err := b.src.Read(b.buf[b.w:])
+		b.w += read
+		if read_err != nil {
+			return b.buf[b.r:b.w], read_err
+		}
+		if read > 0 {
+			empty_reads = 0
+		} else if empty_reads++; empty_reads >= maxEmptyReads {
+			return b.buf[b.r:b.w], io.ErrNoProgress
+		}
+	}
+	return b.buf[b.r : b.r+n], err
+}
+
+// makeRoom makes space to read at least n bytes past the unread ones,
+// moving them to the front and growing the buffer as needed.
+func (b *buffer) makeRoom(n int) {
+	if len(b.buf)-b.r >= n && b.w < len(b.buf) {
+		return
+	}
+	if len(b.buf) < n {
+		size := max(len(b.buf), initialBufferSize)
+		for size < n {
+			size *= 2
+		}
+		grown := make([]byte, min(size, b.max))
+		b.w = copy(grown, b.buf[b.r:b.w])
+		b.buf, b.r = grown, 0
+		return
+	}
+	b.w = copy(b.buf, b.buf[b.r:b.w])
+	b.r = 0
+}
+
+// discard drops the next n buffered bytes.
+func (b *buffer) discard(n int) {
+	b.r += n
+	if b.r == b.w {
+		b.r, b.w = 0, 0
+		// let go of what a long head grew the buffer to
+		if len(b.buf) > initialBufferSize {
+			b.buf = nil
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package request
+
+// Error is a request the parser had to reject. StatusCode is the HTTP status
+// a server should answer it with.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+var (
+	ErrMalformedRequestLine      = &Error{StatusCode: 400, Message: "malformed request line"}
+	ErrInvalidMethod             = &Error{StatusCode: 400, Message: "invalid method"}
+	ErrUnsupportedVersion        = &Error{StatusCode: 505, Message: "HTTP version not supported"}
+	ErrInvalidTarget             = &Error{StatusCode: 400, Message: "invalid request target"}
+	ErrURITooLong                = &Error{StatusCode: 414, Message: "request target too long"}
+	ErrInvalidContentLength      = &Error{StatusCode: 400, Message: "invalid content-length"}
+	ErrInvalidTransferEncoding   = &Error{StatusCode: 400, Message: "invalid transfer-encoding"}
+	ErrUnsupportedTransferCoding = &Error{StatusCode: 501, Message: "unsupported transfer coding"}
+	ErrMalformedChunk            = &Error{StatusCode: 400, Message: "malformed chunked body"}
+	ErrIncompleteRequest         = &Error{StatusCode: 400, Message: "incomplete request"}
+	ErrBodyTooLarge              = &Error{StatusCode: 413, Message: "request body too large"}
+)
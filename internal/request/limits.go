@@ -0,0 +1,42 @@
+package request
+
+// Limits bounds how much of a request the parser accepts before rejecting it.
+// Zero fields fall back to the values in DefaultLimits.
+type Limits struct {
+	// MaxRequestLineBytes bounds the request line, without its CRLF.
+	MaxRequestLineBytes int
+	// MaxHeaderBytes bounds the header section, field lines and their CRLFs
+	// included. Trailers of a chunked body are held to the same limit.
+	MaxHeaderBytes int
+	// MaxHeaderCount bounds the number of header field lines.
+	MaxHeaderCount int
+	// MaxBodyBytes bounds the decoded body. Zero or less means no limit, as
+	// bodies are streamed rather than held in memory.
+	MaxBodyBytes int64
+}
+
+var DefaultLimits = Limits{
+	MaxRequestLineBytes: 8 << 10,
+	MaxHeaderBytes:      32 << 10,
+	MaxHeaderCount:      100,
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxRequestLineBytes <= 0 {
+		l.MaxRequestLineBytes = DefaultLimits.MaxRequestLineBytes
+	}
+	if l.MaxHeaderBytes <= 0 {
+		l.MaxHeaderBytes = DefaultLimits.MaxHeaderBytes
+	}
+	if l.MaxHeaderCount <= 0 {
+		l.MaxHeaderCount = DefaultLimits.MaxHeaderCount
+	}
+	return l
+}
+
+// bufferSize is what the buffer of a connection may grow to, enough to hold
+// the longest acceptable line plus its CRLF, so a line that does not fit is
+// always over the limit.
+func (l Limits) bufferSize() int {
+	return max(l.MaxRequestLineBytes, l.MaxHeaderBytes) + len(crlf)
+}
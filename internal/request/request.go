@@ -2,10 +2,12 @@ package request
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"io"
+	"slices"
 	"strconv"
 	"strings"
 	"unicode"
@@ -17,74 +19,276 @@ const (
 	request_initialized RequestState = iota
 	request_parsing_headers
 	request_parsing_body
+	request_parsing_chunk_size
+	request_parsing_chunk_data
+	request_parsing_chunk_data_end
+	request_parsing_trailers
 	request_done
 )
 
 type Request struct {
 	RequestLine RequestLine
-	Headers     headers.Headers
-	Body        []byte
-	State       RequestState
+	Headers     *headers.Headers
+	// Body streams the request body from the connection as the handler reads
+	// it. It is never nil, a request without a body reads as empty.
+	Body io.ReadCloser
+	// Trailers holds the trailer fields sent after a chunked body. It is
+	// only filled in once Body has been read to EOF.
+	Trailers *headers.Headers
+	// PathParams holds the path segments captured by the route the request
+	// was dispatched to, keyed by parameter name.
+	PathParams map[string]string
+	// RemoteAddr is the network address of the client, as set by the server.
+	RemoteAddr string
+	State      RequestState
+
+	ctx           context.Context
+	limits        Limits
+	headerBytes   int
+	headerCount   int
+	bodyRemaining uint64
+	bodyBytes     uint64
+	body          *body
 }
 
 type RequestLine struct {
 	HttpVersion   string
 	RequestTarget string
 	Method        string
+	// Target is RequestTarget parsed into its parts.
+	Target Target
 }
 
 const crlf = "\r\n"
-const buffer_size = 8
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
-	request := Request{
-		State:   request_initialized,
-		Headers: headers.NewHeaders(),
-		Body:    make([]byte, 0),
+// Reader reads successive requests from a single connection. Bytes read past
+// the end of one request are kept for the next one, so pipelined requests are
+// handed out in the order they were sent.
+type Reader struct {
+	reader  *buffer
+	limits  Limits
+	want    int
+	current *Request
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return NewReaderWithLimits(reader, DefaultLimits)
+}
+
+// NewReaderWithLimits returns a Reader that rejects requests exceeding
+// limits with ErrURITooLong, headers.ErrHeaderTooLarge or ErrBodyTooLarge.
+func NewReaderWithLimits(reader io.Reader, limits Limits) *Reader {
+	limits = limits.withDefaults()
+	return &Reader{
+		reader: newBuffer(reader, limits.bufferSize()),
+		limits: limits,
+		want:   1,
 	}
-	read_to_idx := 0
-	buf := make([]byte, buffer_size)
+}
 
-	for request.State != request_done {
-		if read_to_idx >= len(buf) {
-			new_buf := make([]byte, len(buf)*2)
-			copy(new_buf, buf)
-			buf = new_buf
+// RequestFromReader reads a single request from reader. Use a Reader to read
+// more than one request from the same connection.
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	return NewReader(reader).ReadRequest()
+}
+
+// Wait blocks until the first byte of the next request is available, without
+// consuming it. It lets a caller tell an idle connection from one that is
+// in the middle of sending a request.
+func (rr *Reader) Wait() error {
+	_, err := rr.reader.peek(1)
+	return err
+}
+
+// ReadRequest reads the next request line and headers. The body is left on
+// the connection for the caller to read through Request.Body, whatever is
+// left unread of it is discarded by the following ReadRequest call.
+// ReadRequest returns io.EOF if the connection was closed before any byte of
+// a new request arrived, and an error matching both ErrIncompleteRequest and
+// io.ErrUnexpectedEOF if it was closed in the middle of the head.
+func (rr *Reader) ReadRequest() (*Request, error) {
+	if rr.current != nil {
+		if err := rr.current.DiscardBody(); err != nil {
+			return nil, err
 		}
-		bytes_read, err := reader.Read(buf[read_to_idx:])
+		rr.current = nil
+	}
+	request := &Request{
+		State:    request_initialized,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		limits:   rr.limits,
+	}
+	request.body = &body{request: request, source: rr}
+	request.Body = request.body
+
+	for request.State == request_initialized || request.State == request_parsing_headers {
+		_, err := rr.parse(request, nil)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				if request.State != request_done {
-					return nil, fmt.Errorf("reached EOF without request being done")
+				if request.State == request_initialized && rr.reader.buffered() == 0 {
+					return nil, io.EOF
 				}
-				break
+				return nil, fmt.Errorf("%w: %w in the request head", ErrIncompleteRequest, io.ErrUnexpectedEOF)
 			}
 			return nil, err
 		}
-		read_to_idx += bytes_read
-		bytes_parsed, err := request.parse(buf[:read_to_idx])
-		if err != nil {
-			return nil, err
+	}
+	rr.current = request
+	return request, nil
+}
+
+// parse feeds the buffered bytes to the request parser, copying body bytes
+// into body. When nothing could be parsed from what is buffered it waits for
+// at least one more byte from the connection before the next call. An error
+// reading the connection is only returned once the bytes that came with it
+// have been parsed, as they may well complete the request.
+func (rr *Reader) parse(request *Request, body []byte) (int, error) {
+	data, read_err := rr.reader.peek(max(rr.reader.buffered(), rr.want))
+	// only a chunk size line can outgrow the buffer, the request line and
+	// field lines are held to their limits before that
+	if errors.Is(read_err, errBufferFull) {
+		return 0, fmt.Errorf("%w: chunk size line longer than %d bytes", ErrMalformedChunk, len(data))
+	}
+	state := request.State
+	bytes_parsed, bytes_copied, err := request.parse(data, body)
+	if err != nil {
+		return 0, err
+	}
+	rr.reader.discard(bytes_parsed)
+	if bytes_parsed == 0 && request.State == state {
+		if read_err != nil {
+			return 0, read_err
 		}
-		copy(buf, buf[bytes_parsed:])
-		read_to_idx -= bytes_parsed
+		rr.want = len(data) + 1
+	} else {
+		rr.want = 1
 	}
-	return &request, nil
+	return bytes_copied, nil
 }
 
-func (r *Request) parse(data []byte) (int, error) {
+func (r *Request) parse(data []byte, body []byte) (int, int, error) {
 	total_bytes_parsed := 0
+	bytes_copied := 0
 	for r.State != request_done {
-		bytes_parsed, err := r.parseSingle(data[total_bytes_parsed:])
-		if err != nil {
-			return 0, err
+		// without a body to copy into, stop once the head has been parsed
+		if body == nil && r.State != request_initialized && r.State != request_parsing_headers {
+			break
+		}
+		state := r.State
+		bytes_parsed := 0
+		if r.State == request_parsing_body || r.State == request_parsing_chunk_data {
+			bytes_parsed = r.copyBody(data[total_bytes_parsed:], body[bytes_copied:])
+			bytes_copied += bytes_parsed
+		} else {
+			var err error
+			bytes_parsed, err = r.parseSingle(data[total_bytes_parsed:])
+			if err != nil {
+				return 0, 0, err
+			}
 		}
-		if bytes_parsed == 0 {
+		if bytes_parsed == 0 && r.State == state {
 			break
 		}
 		total_bytes_parsed += bytes_parsed
 	}
-	return total_bytes_parsed, nil
+	return total_bytes_parsed, bytes_copied, nil
+}
+
+// copyBody copies body bytes of the current Content-Length body or chunk
+// from data to body. Anything past the end of them is left in data.
+func (r *Request) copyBody(data []byte, body []byte) int {
+	n := copy(body, data[:min(r.bodyRemaining, uint64(len(data)))])
+	r.bodyRemaining -= uint64(n)
+	if r.bodyRemaining == 0 {
+		if r.State == request_parsing_chunk_data {
+			r.State = request_parsing_chunk_data_end
+		} else {
+			r.State = request_done
+		}
+	}
+	return n
+}
+
+// startBody works out how the body is framed once the headers are in, by
+// the strict rules of RFC 9112. Any ambiguity is rejected rather than
+// resolved, as a server and a proxy in front of it resolving it differently
+// would let a client smuggle a request past the proxy.
+func (r *Request) startBody() error {
+	transfer_encodings := r.Headers.Values("Transfer-Encoding")
+	content_lengths := r.Headers.Values("Content-Length")
+	if len(transfer_encodings) > 0 {
+		if r.RequestLine.HttpVersion == "1.0" {
+			return fmt.Errorf("%w: not defined for HTTP/1.0", ErrInvalidTransferEncoding)
+		}
+		if len(content_lengths) > 0 {
+			return fmt.Errorf("%w: sent along with content-length", ErrInvalidTransferEncoding)
+		}
+		if err := checkTransferCodings(transfer_encodings); err != nil {
+			return err
+		}
+		r.State = request_parsing_chunk_size
+		return nil
+	}
+	if len(content_lengths) == 0 {
+		r.State = request_done
+		return nil
+	}
+	if len(content_lengths) > 1 {
+		return fmt.Errorf("%w: sent %d times", ErrInvalidContentLength, len(content_lengths))
+	}
+	content_length, err := parseContentLength(content_lengths[0])
+	if err != nil {
+		return err
+	}
+	if r.limits.MaxBodyBytes > 0 && int64(content_length) > r.limits.MaxBodyBytes {
+		return fmt.Errorf("%w: content-length %d exceeds %d bytes", ErrBodyTooLarge, content_length, r.limits.MaxBodyBytes)
+	}
+	if content_length == 0 {
+		r.State = request_done
+		return nil
+	}
+	r.bodyRemaining = content_length
+	r.State = request_parsing_body
+	return nil
+}
+
+// parseContentLength parses a Content-Length value, which must be a plain
+// run of digits: no sign, no spaces and no list of lengths.
+func parseContentLength(value string) (uint64, error) {
+	if value == "" || strings.ContainsFunc(value, func(r rune) bool { return r < '0' || r > '9' }) {
+		return 0, fmt.Errorf("%w: '%s' is not a number of bytes", ErrInvalidContentLength, value)
+	}
+	content_length, err := strconv.ParseUint(value, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("%w: '%s' is out of range", ErrInvalidContentLength, value)
+	}
+	return content_length, nil
+}
+
+// checkTransferCodings checks the codings listed by the Transfer-Encoding
+// fields end in chunked, the only one that tells where the body ends, and
+// that there are no others, which the parser cannot decode.
+func checkTransferCodings(transfer_encodings []string) error {
+	var codings []string
+	for _, list := range transfer_encodings {
+		for coding := range strings.SplitSeq(list, ",") {
+			if coding = strings.Trim(coding, " \t"); coding != "" {
+				codings = append(codings, strings.ToLower(coding))
+			}
+		}
+	}
+	if len(codings) == 0 || codings[len(codings)-1] != "chunked" {
+		return fmt.Errorf("%w: chunked is not the final coding of '%s'", ErrInvalidTransferEncoding, strings.Join(transfer_encodings, ", "))
+	}
+	codings = codings[:len(codings)-1]
+	if slices.Contains(codings, "chunked") {
+		return fmt.Errorf("%w: chunked applied more than once", ErrInvalidTransferEncoding)
+	}
+	if len(codings) > 0 {
+		return fmt.Errorf("%w: %s", ErrUnsupportedTransferCoding, strings.Join(codings, ", "))
+	}
+	return nil
 }
 
 func (r *Request) parseSingle(data []byte) (int, error) {
@@ -94,39 +298,69 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		if err != nil {
 			return 0, err
 		}
-		if request_line != nil {
-			r.RequestLine = *request_line
-			r.State = request_parsing_headers
-			return bytes_parsed, nil
+		if request_line == nil {
+			if len(data) >= r.limits.MaxRequestLineBytes+len(crlf) {
+				return 0, fmt.Errorf("%w: request line longer than %d bytes", ErrURITooLong, r.limits.MaxRequestLineBytes)
+			}
+			return 0, nil
+		}
+		if bytes_parsed-len(crlf) > r.limits.MaxRequestLineBytes {
+			return 0, fmt.Errorf("%w: request line longer than %d bytes", ErrURITooLong, r.limits.MaxRequestLineBytes)
 		}
-		return 0, nil
+		r.RequestLine = *request_line
+		r.State = request_parsing_headers
+		return bytes_parsed, nil
 	case request_parsing_headers:
-		bytes_parsed, done, err := r.Headers.Parse(data)
+		bytes_parsed, done, err := r.parseFields(r.Headers, data)
 		if err != nil {
 			return 0, err
 		}
 		if done {
-			r.State = request_parsing_body
+			if err := r.startBody(); err != nil {
+				return 0, err
+			}
 		}
 		return bytes_parsed, nil
-	case request_parsing_body:
-		content_length_header, ok := r.Headers.Get("Content-Length")
-		if !ok {
-			r.State = request_done
-			return len(data), nil
+	case request_parsing_chunk_size:
+		crlf_idx := bytes.Index(data, []byte(crlf))
+		if crlf_idx == -1 {
+			return 0, nil
 		}
-		r.Body = append(r.Body, data...)
-		content_length, err := strconv.Atoi(content_length_header)
+		chunk_size, err := parseChunkSizeLine(string(data[:crlf_idx]))
 		if err != nil {
-			return 0, fmt.Errorf("couldn't convert %s to int", content_length_header)
+			return 0, err
 		}
-		if len(r.Body) > content_length {
-			return 0, fmt.Errorf("length of the body greater than content-length header")
+		r.bodyBytes += chunk_size
+		if r.limits.MaxBodyBytes > 0 && r.bodyBytes > uint64(r.limits.MaxBodyBytes) {
+			return 0, fmt.Errorf("%w: chunked body longer than %d bytes", ErrBodyTooLarge, r.limits.MaxBodyBytes)
 		}
-		if len(r.Body) == content_length {
+		if chunk_size == 0 {
+			r.headerBytes = 0
+			r.headerCount = 0
+			r.State = request_parsing_trailers
+		} else {
+			r.bodyRemaining = chunk_size
+			r.State = request_parsing_chunk_data
+		}
+		return crlf_idx + len(crlf), nil
+	case request_parsing_chunk_data_end:
+		if len(data) < len(crlf) {
+			return 0, nil
+		}
+		if !bytes.HasPrefix(data, []byte(crlf)) {
+			return 0, fmt.Errorf("%w: chunk data not followed by CRLF", ErrMalformedChunk)
+		}
+		r.State = request_parsing_chunk_size
+		return len(crlf), nil
+	case request_parsing_trailers:
+		bytes_parsed, done, err := r.parseFields(r.Trailers, data)
+		if err != nil {
+			return 0, err
+		}
+		if done {
 			r.State = request_done
 		}
-		return len(data), nil
+		return bytes_parsed, nil
 	case request_done:
 		return 0, fmt.Errorf("error: parsing when request is done")
 	default:
@@ -134,26 +368,167 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	}
 }
 
+// parseFields parses a header or trailer field line into fields, holding the
+// section to the header size and count limits.
+func (r *Request) parseFields(fields *headers.Headers, data []byte) (int, bool, error) {
+	bytes_parsed, done, err := fields.Parse(data)
+	if err != nil {
+		return 0, false, err
+	}
+	if bytes_parsed == 0 {
+		if r.headerBytes+len(data) > r.limits.MaxHeaderBytes {
+			return 0, false, fmt.Errorf("%w: more than %d bytes", headers.ErrHeaderTooLarge, r.limits.MaxHeaderBytes)
+		}
+		return 0, false, nil
+	}
+	r.headerBytes += bytes_parsed
+	if r.headerBytes > r.limits.MaxHeaderBytes {
+		return 0, false, fmt.Errorf("%w: more than %d bytes", headers.ErrHeaderTooLarge, r.limits.MaxHeaderBytes)
+	}
+	if !done {
+		r.headerCount++
+		if r.headerCount > r.limits.MaxHeaderCount {
+			return 0, false, fmt.Errorf("%w: more than %d fields", headers.ErrHeaderTooLarge, r.limits.MaxHeaderCount)
+		}
+	}
+	return bytes_parsed, done, nil
+}
+
+// parseChunkSizeLine parses chunk-size [ chunk-ext ] from a chunked body.
+// Chunk extensions are checked for syntax and otherwise ignored.
+func parseChunkSizeLine(line string) (uint64, error) {
+	size, extensions, _ := strings.Cut(line, ";")
+	size = strings.TrimRight(size, " \t")
+	chunk_size, err := strconv.ParseUint(size, 16, 63)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid chunk size '%s'", ErrMalformedChunk, size)
+	}
+	if extensions == "" {
+		return chunk_size, nil
+	}
+	for _, extension := range splitChunkExtensions(extensions) {
+		name, value, has_value := strings.Cut(extension, "=")
+		if !headers.IsToken(strings.Trim(name, " \t")) {
+			return 0, fmt.Errorf("%w: invalid chunk extension '%s'", ErrMalformedChunk, extension)
+		}
+		value = strings.Trim(value, " \t")
+		if has_value && !headers.IsToken(value) && !isQuotedString(value) {
+			return 0, fmt.Errorf("%w: invalid chunk extension value '%s'", ErrMalformedChunk, value)
+		}
+	}
+	return chunk_size, nil
+}
+
+// splitChunkExtensions splits chunk extensions at the ";" between them,
+// leaving alone those within a quoted-string value. An unterminated quote
+// runs to the end, for isQuotedString to reject.
+func splitChunkExtensions(extensions string) []string {
+	var split []string
+	start := 0
+	in_quotes := false
+	for i := 0; i < len(extensions); i++ {
+		switch c := extensions[i]; {
+		case in_quotes && c == '\\':
+			i++
+		case c == '"':
+			in_quotes = !in_quotes
+		case !in_quotes && c == ';':
+			split = append(split, extensions[start:i])
+			start = i + 1
+		}
+	}
+	return append(split, extensions[start:])
+}
+
+func isQuotedString(s string) bool {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return false
+	}
+	for i := 1; i < len(s)-1; i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+			if i == len(s)-1 {
+				return false
+			}
+		case s[i] == '"':
+			return false
+		}
+	}
+	return true
+}
+
 func parseRequestLine(data []byte) (*RequestLine, int, error) {
 	crlf_idx := bytes.Index(data, []byte(crlf))
 	if crlf_idx == -1 {
 		return nil, 0, nil
 	}
 	request_line_string := string(data[:crlf_idx])
+	if strings.ContainsAny(request_line_string, "\r\n") {
+		return nil, 0, fmt.Errorf("%w: bare CR or LF", ErrMalformedRequestLine)
+	}
 	request_line_split := strings.Split(request_line_string, " ")
 	if len(request_line_split) != 3 {
-		return nil, 0, errors.New("invalid number of request line parts")
+		return nil, 0, fmt.Errorf("%w: invalid number of request line parts", ErrMalformedRequestLine)
 	}
 	method := request_line_split[0]
 	for _, rune := range method {
 		if !unicode.IsUpper(rune) {
-			return nil, 0, errors.New("method should only contain uppercase letters")
+			return nil, 0, fmt.Errorf("%w: method should only contain uppercase letters", ErrInvalidMethod)
 		}
 	}
 	http_version_split := strings.Split(request_line_split[2], "/")
-	if len(http_version_split) != 2 || http_version_split[1] != "1.1" || http_version_split[0] != "HTTP" {
-		return nil, 0, errors.New("invalid HTTP version")
+	if len(http_version_split) != 2 || http_version_split[0] != "HTTP" || !isVersionNumber(http_version_split[1]) {
+		return nil, 0, fmt.Errorf("%w: invalid HTTP version %s", ErrMalformedRequestLine, request_line_split[2])
+	}
+	// any HTTP/1.x is understood as the highest minor version we speak
+	if http_version_split[1][0] != '1' {
+		return nil, 0, fmt.Errorf("%w: HTTP/%s", ErrUnsupportedVersion, http_version_split[1])
 	}
 	http_version := http_version_split[1]
-	return &RequestLine{HttpVersion: http_version, RequestTarget: request_line_split[1], Method: method}, crlf_idx + len(crlf), nil
+	target, err := parseTarget(method, request_line_split[1])
+	if err != nil {
+		return nil, 0, err
+	}
+	return &RequestLine{HttpVersion: http_version, RequestTarget: request_line_split[1], Method: method, Target: target}, crlf_idx + len(crlf), nil
+}
+
+// isVersionNumber reports whether version has the DIGIT "." DIGIT form of an
+// HTTP-version.
+func isVersionNumber(version string) bool {
+	return len(version) == 3 && version[1] == '.' &&
+		version[0] >= '0' && version[0] <= '9' && version[2] >= '0' && version[2] <= '9'
+}
+
+// Context returns the context of the request, which middleware uses to carry
+// values along with it and to cancel it. It is never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx.
+// The copy shares its body with r.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// PathParam returns the path segment captured under name by the route the
+// request was dispatched to, or the empty string if there is none.
+func (r *Request) PathParam(name string) string {
+	return r.PathParams[name]
+}
+
+// KeepAlive reports whether the client allows the connection to be reused for
+// another request after this one has been answered.
+// HTTP/1.0 connections are closed unless the client asks for keep-alive.
+func (r *Request) KeepAlive() bool {
+	if r.RequestLine.HttpVersion == "1.0" {
+		return r.Headers.HasToken("Connection", "keep-alive")
+	}
+	return !r.Headers.HasToken("Connection", "close")
 }
@@ -1,9 +1,12 @@
 package request
 
 import (
+	"errors"
+	"httpfromtcp/internal/headers"
 	"io"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -28,6 +31,26 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// get returns the value of the first field named key, "" if there is none
+func get(h *headers.Headers, key string) string {
+	v, _ := h.Get(key)
+	return v
+}
+
+// readFullRequest reads a request and its whole body, returning the first
+// error from either
+func readFullRequest(reader io.Reader) (*Request, string, error) {
+	r, err := RequestFromReader(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := r.ReadBody()
+	if err != nil {
+		return nil, "", err
+	}
+	return r, string(body), nil
+}
+
 func TestRequestLineParse(t *testing.T) {
 	// Test: Good GET Request line
 	reader := &chunkReader{
@@ -104,9 +127,9 @@ func TestHeadersParse(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", get(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(r.Headers, "user-agent"))
+	assert.Equal(t, "*/*", get(r.Headers, "accept"))
 
 	// Test: Malformed Header
 	reader = &chunkReader{
@@ -124,7 +147,7 @@ func TestHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Empty(t, r.Headers)
+	assert.Equal(t, 0, r.Headers.Len())
 
 	// Test: Duplicate Headers
 	reader = &chunkReader{
@@ -134,7 +157,7 @@ func TestHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069, hostlocal:69420", r.Headers["host"])
+	assert.Equal(t, []string{"localhost:42069", "hostlocal:69420"}, r.Headers.Values("host"))
 
 	// Test: Case insensitive Headers
 	reader = &chunkReader{
@@ -144,9 +167,9 @@ func TestHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", get(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(r.Headers, "user-agent"))
+	assert.Equal(t, "*/*", get(r.Headers, "accept"))
 
 	// Test: Missing end of Headers
 	reader = &chunkReader{
@@ -167,10 +190,10 @@ func TestBodyParse(t *testing.T) {
 			"hello world!\n",
 		numBytesPerRead: 3,
 	}
-	r, err := RequestFromReader(reader)
+	r, body, err := readFullRequest(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.Equal(t, "hello world!\n", body)
 
 	// Test: Empty Body, 0 reported content length
 	reader = &chunkReader{
@@ -180,10 +203,10 @@ func TestBodyParse(t *testing.T) {
 			"\r\n",
 		numBytesPerRead: 3,
 	}
-	r, err = RequestFromReader(reader)
+	r, body, err = readFullRequest(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", string(r.Body))
+	assert.Equal(t, "", body)
 
 	// Test: Empty Body, no reported content length
 	reader = &chunkReader{
@@ -192,10 +215,10 @@ func TestBodyParse(t *testing.T) {
 			"\r\n",
 		numBytesPerRead: 3,
 	}
-	r, err = RequestFromReader(reader)
+	r, body, err = readFullRequest(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", string(r.Body))
+	assert.Equal(t, "", body)
 
 	// Test: No Content-Length but Body Exists
   reader = &chunkReader{
@@ -205,10 +228,10 @@ func TestBodyParse(t *testing.T) {
       "body\n",
 		numBytesPerRead: 3,
 	}
-	r, err = RequestFromReader(reader)
+	r, body, err = readFullRequest(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", string(r.Body))
+	assert.Equal(t, "", body)
 
 	// Test: Body shorter than reported content length
 	reader = &chunkReader{
@@ -219,10 +242,11 @@ func TestBodyParse(t *testing.T) {
 			"partial content",
 		numBytesPerRead: 3,
 	}
-	r, err = RequestFromReader(reader)
+	r, body, err = readFullRequest(reader)
 	require.Error(t, err)
 
-	// Test: Body longer than reported content length
+	// Test: Body longer than reported content length, the rest is left for
+	// the next request
 	reader = &chunkReader{
 		data: "POST /submit HTTP/1.1\r\n" +
 			"Host: localhost:42069\r\n" +
@@ -231,7 +255,14 @@ func TestBodyParse(t *testing.T) {
 			"body",
 		numBytesPerRead: 3,
 	}
-	r, err = RequestFromReader(reader)
+	requestReader := NewReader(reader)
+	r, err = requestReader.ReadRequest()
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	bodyBytes, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(bodyBytes))
+	_, err = requestReader.ReadRequest()
 	require.Error(t, err)
 
 	// Test: Content-Length header value not an int
@@ -243,6 +274,492 @@ func TestBodyParse(t *testing.T) {
 			"body",
 		numBytesPerRead: 3,
 	}
-	r, err = RequestFromReader(reader)
+	r, body, err = readFullRequest(reader)
 	require.Error(t, err)
 }
+
+func TestKeepAlive(t *testing.T) {
+	// Test: HTTP/1.1 defaults to keep-alive
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: Connection: close
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	// Test: close token in a list, mixed case
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\nConnection: Upgrade, CLOSE\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 defaults to close
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.False(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 with keep-alive
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: Later HTTP/1.x minor versions are understood as HTTP/1.1
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.2\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	// Test: Two pipelined requests, the first with a body
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /coffee HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	}
+	requestReader := NewReader(reader)
+	r, err := requestReader.ReadRequest()
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "POST", r.RequestLine.Method)
+	bodyBytes, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(bodyBytes))
+	r, err = requestReader.ReadRequest()
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "GET", r.RequestLine.Method)
+	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
+	_, err = requestReader.ReadRequest()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Bodyless request followed by another one in the same read
+	data := "GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n\r\n"
+	requestReader = NewReader(&chunkReader{data: data, numBytesPerRead: len(data)})
+	r, err = requestReader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.RequestTarget)
+	r, err = requestReader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+
+	// Test: Connection closed in the middle of a request
+	requestReader = NewReader(strings.NewReader("GET /a HTTP/1.1\r\nHost: loc"))
+	_, err = requestReader.ReadRequest()
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, io.EOF)
+}
+
+func TestChunkedBodyParse(t *testing.T) {
+	// Test: Chunked body
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n" +
+			"7\r\nworld!\n\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, body, err := readFullRequest(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!\n", body)
+	assert.Equal(t, 0, r.Trailers.Len())
+
+	// Test: Chunk extensions and trailers
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"a;name=value;quoted=\"a \\\"b\\\"\";flag\r\n0123456789\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n",
+		numBytesPerRead: 5,
+	}
+	r, body, err = readFullRequest(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "0123456789", body)
+	checksum, ok := r.Trailers.Get("X-Checksum")
+	assert.True(t, ok)
+	assert.Equal(t, "abc", checksum)
+
+	// Test: Chunk extension with a quoted ";" in its value
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3;a=\"x;y\";b=\"\\\";\"\r\nabc\r\n" +
+			"0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, body, err = readFullRequest(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", body)
+
+	// Test: Chunk extension with an unterminated quote
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3;a=\"x;y\r\nabc\r\n" +
+			"0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, _, err = readFullRequest(reader)
+	require.ErrorIs(t, err, ErrMalformedChunk)
+
+	// Test: Request after a chunked body is not consumed
+	requestReader := NewReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"3\r\nabc\r\n0\r\n\r\n" +
+		"GET /next HTTP/1.1\r\n\r\n"))
+	r, err = requestReader.ReadRequest()
+	require.NoError(t, err)
+	bodyBytes, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(bodyBytes))
+	r, err = requestReader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+
+	// Test: Invalid chunk size
+	_, _, err = readFullRequest(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nabc\r\n0\r\n\r\n"))
+	require.Error(t, err)
+
+	// Test: Chunk data longer than chunk size
+	_, _, err = readFullRequest(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nabc\r\n0\r\n\r\n"))
+	require.Error(t, err)
+
+	// Test: Invalid chunk extension
+	_, _, err = readFullRequest(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3;bad ext\r\nabc\r\n0\r\n\r\n"))
+	require.Error(t, err)
+
+	// Test: Missing last chunk
+	_, _, err = readFullRequest(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n"))
+	require.Error(t, err)
+}
+
+func TestStreamingBody(t *testing.T) {
+	// Test: Request is returned before the body has arrived
+	reader, writer := io.Pipe()
+	go writer.Write([]byte("POST /submit HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello"))
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	buf := make([]byte, 10)
+	n, err := r.Body.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+	go func() {
+		writer.Write([]byte("world"))
+		writer.Close()
+	}()
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(body))
+
+	// Test: Unread body is skipped before the next request
+	requestReader := NewReader(strings.NewReader("POST /a HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"3\r\nabc\r\n3\r\ndef\r\n0\r\n\r\n" +
+		"POST /b HTTP/1.1\r\nContent-Length: 3\r\n\r\nxyz"))
+	r, err = requestReader.ReadRequest()
+	require.NoError(t, err)
+	require.NoError(t, r.Body.Close())
+	r, err = requestReader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "xyz", string(body))
+
+	// Test: Truncated body
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello"))
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestParseErrors(t *testing.T) {
+	// Test: Errors carry the status code to answer with
+	tests := []struct {
+		name       string
+		data       string
+		err        error
+		statusCode int
+	}{
+		{"missing request line part", "GET HTTP/1.1\r\n\r\n", ErrMalformedRequestLine, 400},
+		{"lowercase method", "get / HTTP/1.1\r\n\r\n", ErrInvalidMethod, 400},
+		{"malformed version", "GET / HTTP/one\r\n\r\n", ErrMalformedRequestLine, 400},
+		{"unsupported version", "GET / HTTP/2.1\r\n\r\n", ErrUnsupportedVersion, 505},
+		{"unsupported HTTP/0.9", "GET / HTTP/0.9\r\n\r\n", ErrUnsupportedVersion, 505},
+		{"request line too long", "GET /" + strings.Repeat("a", 10000) + " HTTP/1.1\r\n\r\n", ErrURITooLong, 414},
+		{"header line too long", "GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", 40000) + "\r\n\r\n", headers.ErrHeaderTooLarge, 431},
+		{"invalid content-length", "POST / HTTP/1.1\r\nContent-Length: abc\r\n\r\n", ErrInvalidContentLength, 400},
+		{"malformed header", "GET / HTTP/1.1\r\nHost localhost\r\n\r\n", headers.ErrMalformedFieldLine, 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := RequestFromReader(strings.NewReader(tt.data))
+			require.ErrorIs(t, err, tt.err)
+			var requestErr *Error
+			var headersErr *headers.Error
+			switch {
+			case errors.As(err, &requestErr):
+				assert.Equal(t, tt.statusCode, requestErr.StatusCode)
+			case errors.As(err, &headersErr):
+				assert.Equal(t, tt.statusCode, headersErr.StatusCode)
+			default:
+				t.Fatalf("untyped error %v", err)
+			}
+		})
+	}
+
+	// Test: Malformed chunk surfaces from the body
+	r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n"))
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, ErrMalformedChunk)
+}
+
+func TestReaderBuffer(t *testing.T) {
+	limits := Limits{MaxHeaderBytes: 1 << 20}
+	long := strings.Repeat("a", 20<<10)
+	reader := NewReaderWithLimits(strings.NewReader(
+		"GET / HTTP/1.1\r\nHost: a\r\n\r\n"+
+			"GET / HTTP/1.1\r\nX-Long: "+long+"\r\n\r\n"+
+			"GET / HTTP/1.1\r\n\r\n"), limits)
+
+	// Test: Buffer does not start at the size of the limits
+	_, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(reader.reader.buf), initialBufferSize)
+
+	// Test: Buffer grows for a line longer than it
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	value, _ := r.Headers.Get("X-Long")
+	assert.Equal(t, long, value)
+
+	// Test: Buffer shrinks back once the long line is consumed
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(reader.reader.buf), initialBufferSize)
+}
+
+func TestLimits(t *testing.T) {
+	limits := Limits{
+		MaxRequestLineBytes: 20,
+		MaxHeaderBytes:      40,
+		MaxHeaderCount:      2,
+		MaxBodyBytes:        5,
+	}
+
+	// Test: Request within all limits
+	r, err := NewReaderWithLimits(strings.NewReader("POST /12345 HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello"), limits).ReadRequest()
+	require.NoError(t, err)
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: Request line too long, with and without its CRLF received
+	_, err = NewReaderWithLimits(strings.NewReader("POST /123456 HTTP/1.1\r\n\r\n"), limits).ReadRequest()
+	assert.ErrorIs(t, err, ErrURITooLong)
+	_, err = NewReaderWithLimits(&chunkReader{data: "GET /" + strings.Repeat("a", 100), numBytesPerRead: 3}, limits).ReadRequest()
+	assert.ErrorIs(t, err, ErrURITooLong)
+
+	// Test: Header section too large
+	_, err = NewReaderWithLimits(strings.NewReader("GET / HTTP/1.1\r\nX-A: "+strings.Repeat("a", 40)+"\r\n\r\n"), limits).ReadRequest()
+	assert.ErrorIs(t, err, headers.ErrHeaderTooLarge)
+
+	// Test: Too many header fields
+	_, err = NewReaderWithLimits(strings.NewReader("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n"), limits).ReadRequest()
+	assert.ErrorIs(t, err, headers.ErrHeaderTooLarge)
+
+	// Test: Content-Length over the body limit is rejected up front
+	_, err = NewReaderWithLimits(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 6\r\n\r\nhello!"), limits).ReadRequest()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Chunked body over the body limit fails while reading it
+	r, err = NewReaderWithLimits(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n3\r\ndef\r\n0\r\n\r\n"), limits).ReadRequest()
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestRequestTargetParse(t *testing.T) {
+	// Test: Origin form with a query
+	r, err := RequestFromReader(strings.NewReader("GET /search/caf%C3%A9?q=a+b&q=c%26d&empty= HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	target := r.RequestLine.Target
+	assert.Equal(t, TargetOrigin, target.Form)
+	assert.Equal(t, "/search/café", target.Path)
+	assert.Equal(t, "/search/caf%C3%A9", target.RawPath)
+	assert.Equal(t, "q=a+b&q=c%26d&empty=", target.RawQuery)
+	assert.Equal(t, []string{"a b", "c&d"}, target.Query["q"])
+	assert.Equal(t, "", target.Query.Get("empty"))
+
+	// Test: Query parameters that do not decode are kept as sent
+	r, err = RequestFromReader(strings.NewReader("GET /search?q=a;b&bad=%zz&ok=%41 HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	target = r.RequestLine.Target
+	assert.Equal(t, "q=a;b&bad=%zz&ok=%41", target.RawQuery)
+	assert.Equal(t, "a;b", target.Query.Get("q"))
+	assert.Equal(t, "%zz", target.Query.Get("bad"))
+	assert.Equal(t, "A", target.Query.Get("ok"))
+
+	// Test: Absolute form
+	r, err = RequestFromReader(strings.NewReader("GET HTTP://www.example.org:8080/pub/index.html?x=1 HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	target = r.RequestLine.Target
+	assert.Equal(t, TargetAbsolute, target.Form)
+	assert.Equal(t, "http", target.Scheme)
+	assert.Equal(t, "www.example.org:8080", target.Host)
+	assert.Equal(t, "/pub/index.html", target.Path)
+	assert.Equal(t, "1", target.Query.Get("x"))
+
+	// Test: Absolute form without a path
+	r, err = RequestFromReader(strings.NewReader("GET http://example.org?x=1 HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "/", r.RequestLine.Target.Path)
+	assert.Equal(t, "x=1", r.RequestLine.Target.RawQuery)
+
+	// Test: Authority form for CONNECT
+	r, err = RequestFromReader(strings.NewReader("CONNECT www.example.com:443 HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, TargetAuthority, r.RequestLine.Target.Form)
+	assert.Equal(t, "www.example.com:443", r.RequestLine.Target.Host)
+
+	// Test: Asterisk form for OPTIONS
+	r, err = RequestFromReader(strings.NewReader("OPTIONS * HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, TargetAsterisk, r.RequestLine.Target.Form)
+
+	// Test: Malformed targets
+	for _, line := range []string{
+		"GET * HTTP/1.1",
+		"GET www.example.com:443 HTTP/1.1",
+		"CONNECT /path HTTP/1.1",
+		"CONNECT www.example.com HTTP/1.1",
+		"GET /a#fragment HTTP/1.1",
+		"GET /bad%zzescape HTTP/1.1",
+		"GET /caf\xc3\xa9 HTTP/1.1",
+		"GET http:///no-host HTTP/1.1",
+		"GET 1http://example.org/ HTTP/1.1",
+		"GET relative/path HTTP/1.1",
+	} {
+		_, err = RequestFromReader(strings.NewReader(line + "\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrInvalidTarget, line)
+	}
+}
+
+func TestSmuggling(t *testing.T) {
+	// Test: Known request smuggling vectors are rejected
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"conflicting content-lengths", "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 10\r\n\r\nhello", ErrInvalidContentLength},
+		{"duplicate content-lengths", "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello", ErrInvalidContentLength},
+		{"content-length list", "POST / HTTP/1.1\r\nContent-Length: 5, 10\r\n\r\nhello", ErrInvalidContentLength},
+		{"signed content-length", "POST / HTTP/1.1\r\nContent-Length: +5\r\n\r\nhello", ErrInvalidContentLength},
+		{"negative content-length", "POST / HTTP/1.1\r\nContent-Length: -5\r\n\r\nhello", ErrInvalidContentLength},
+		{"hex content-length", "POST / HTTP/1.1\r\nContent-Length: 0x5\r\n\r\nhello", ErrInvalidContentLength},
+		{"content-length with inner space", "POST / HTTP/1.1\r\nContent-Length: 1 0\r\n\r\nhello", ErrInvalidContentLength},
+		{"empty content-length", "POST / HTTP/1.1\r\nContent-Length:\r\n\r\n", ErrInvalidContentLength},
+		{"overflowing content-length", "POST / HTTP/1.1\r\nContent-Length: 99999999999999999999\r\n\r\n", ErrInvalidContentLength},
+		{"content-length with vertical tab", "POST / HTTP/1.1\r\nContent-Length:\v5\r\n\r\nhello", headers.ErrMalformedFieldLine},
+		{"transfer-encoding with content-length", "POST / HTTP/1.1\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ErrInvalidTransferEncoding},
+		{"content-length with transfer-encoding", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n0\r\n\r\n", ErrInvalidTransferEncoding},
+		{"transfer-encoding in HTTP/1.0", "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ErrInvalidTransferEncoding},
+		{"chunked not final", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked, identity\r\n\r\n0\r\n\r\n", ErrInvalidTransferEncoding},
+		{"chunked twice", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ErrInvalidTransferEncoding},
+		{"obfuscated chunked", "POST / HTTP/1.1\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n", ErrInvalidTransferEncoding},
+		{"chunked with parameter", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked;q=1\r\n\r\n0\r\n\r\n", ErrInvalidTransferEncoding},
+		{"empty transfer-encoding", "POST / HTTP/1.1\r\nTransfer-Encoding:\r\n\r\n", ErrInvalidTransferEncoding},
+		{"unknown coding", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", ErrUnsupportedTransferCoding},
+		{"space before colon", "POST / HTTP/1.1\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n", headers.ErrMalformedFieldLine},
+		{"tab before colon", "POST / HTTP/1.1\r\nTransfer-Encoding\t: chunked\r\n\r\n0\r\n\r\n", headers.ErrMalformedFieldLine},
+		{"obs-fold with tab", "POST / HTTP/1.1\r\nX-Foo: a\r\n\tContent-Length: 5\r\n\r\nhello", headers.ErrMalformedFieldLine},
+		{"obs-fold with space", "POST / HTTP/1.1\r\nX-Foo: a\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n", headers.ErrMalformedFieldLine},
+		{"bare LF in field line", "POST / HTTP/1.1\r\nX-Foo: a\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", headers.ErrMalformedFieldLine},
+		{"bare CR in field line", "POST / HTTP/1.1\r\nX-Foo: a\rTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", headers.ErrMalformedFieldLine},
+		{"NUL in field value", "GET / HTTP/1.1\r\nX-Foo: a\x00b\r\n\r\n", headers.ErrMalformedFieldLine},
+		{"bare LF in request line", "GET /a\nGET /b HTTP/1.1\r\n\r\n", ErrMalformedRequestLine},
+		{"signed chunk size", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n+3\r\nabc\r\n0\r\n\r\n", ErrMalformedChunk},
+		{"prefixed chunk size", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0x3\r\nabc\r\n0\r\n\r\n", ErrMalformedChunk},
+		{"overflowing chunk size", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n10000000000000003\r\nabc\r\n0\r\n\r\n", ErrMalformedChunk},
+		{"bare LF after chunk data", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\n0\r\n\r\n", ErrMalformedChunk},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := readFullRequest(strings.NewReader(tt.data))
+			require.ErrorIs(t, err, tt.err)
+		})
+	}
+
+	// Test: Unambiguous framing is still accepted
+	r, body, err := readFullRequest(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: Chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "abc", body)
+	assert.Equal(t, "POST", r.RequestLine.Method)
+	_, body, err = readFullRequest(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 003\r\n\r\nabc"))
+	require.NoError(t, err)
+	assert.Equal(t, "abc", body)
+}
+
+func TestEOF(t *testing.T) {
+	// Test: Request without a body is complete when the client closes
+	for _, numBytesPerRead := range []int{1, 3, 100} {
+		reader := NewReader(iotest.DataErrReader(&chunkReader{
+			data:            "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			numBytesPerRead: numBytesPerRead,
+		}))
+		r, err := reader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, "/", r.RequestLine.RequestTarget)
+		body, err := r.ReadBody()
+		require.NoError(t, err)
+		assert.Empty(t, body)
+		_, err = reader.ReadRequest()
+		require.ErrorIs(t, err, io.EOF)
+	}
+
+	// Test: Body that ends right at EOF is complete
+	_, body, err := readFullRequest(iotest.DataErrReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello")))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", body)
+
+	// Test: Head cut off by EOF
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n"))
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, err = RequestFromReader(strings.NewReader("GET / HT"))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Content-Length body cut off by EOF
+	r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello"))
+	require.NoError(t, err)
+	body2, err := r.ReadBody()
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, "hello", string(body2))
+	require.ErrorIs(t, r.BodyError(), io.ErrUnexpectedEOF)
+
+	// Test: Chunked body cut off by EOF before the last chunk
+	_, _, err = readFullRequest(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n"))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
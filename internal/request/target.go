@@ -0,0 +1,148 @@
+package request
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// TargetForm is one of the four forms of request-target in RFC 9112.
+type TargetForm int
+
+const (
+	// TargetOrigin is an absolute path with an optional query, /where?q=now.
+	TargetOrigin TargetForm = iota
+	// TargetAbsolute is an absolute URI, as sent to proxies,
+	// http://www.example.org/pub/WWW/TheProject.html.
+	TargetAbsolute
+	// TargetAuthority is the host and port of a CONNECT request,
+	// www.example.com:80.
+	TargetAuthority
+	// TargetAsterisk is the * of a server-wide OPTIONS request.
+	TargetAsterisk
+)
+
+// Target is a parsed request-target.
+type Target struct {
+	Form TargetForm
+	// Scheme is set for the absolute form only.
+	Scheme string
+	// Host is the authority of the absolute and authority forms.
+	Host string
+	// Path is the percent-decoded path of the origin and absolute forms.
+	// An absolute form without a path has the path "/".
+	Path string
+	// RawPath is Path as sent, still percent-encoded.
+	RawPath string
+	// RawQuery is the query as sent, without its "?".
+	RawQuery string
+	// Query holds the decoded query parameters. Decoding is lenient, a
+	// parameter that is not validly encoded is kept as sent.
+	Query url.Values
+}
+
+// parseTarget parses the request-target of a request with method, allowing
+// the authority form for CONNECT and the asterisk form for OPTIONS only.
+func parseTarget(method, target string) (Target, error) {
+	for i := 0; i < len(target); i++ {
+		if target[i] <= ' ' || target[i] >= 0x7f || target[i] == '#' {
+			return Target{}, fmt.Errorf("%w: invalid character %q in %q", ErrInvalidTarget, target[i], target)
+		}
+	}
+	switch {
+	case method == "CONNECT":
+		if !isAuthority(target) {
+			return Target{}, fmt.Errorf("%w: CONNECT target %q is not host:port", ErrInvalidTarget, target)
+		}
+		return Target{Form: TargetAuthority, Host: target}, nil
+	case target == "*":
+		if method != "OPTIONS" {
+			return Target{}, fmt.Errorf("%w: * target for %s", ErrInvalidTarget, method)
+		}
+		return Target{Form: TargetAsterisk}, nil
+	case strings.HasPrefix(target, "/"):
+		parsed := Target{Form: TargetOrigin}
+		return parsed, parsed.parsePathQuery(target)
+	}
+	scheme, rest, found := strings.Cut(target, "://")
+	if !found || !isScheme(scheme) {
+		return Target{}, fmt.Errorf("%w: %q", ErrInvalidTarget, target)
+	}
+	host, path_query := rest, "/"
+	if i := strings.IndexAny(rest, "/?"); i != -1 {
+		host, path_query = rest[:i], rest[i:]
+		if path_query[0] == '?' {
+			path_query = "/" + path_query
+		}
+	}
+	if host == "" || strings.Contains(host, "@") {
+		return Target{}, fmt.Errorf("%w: invalid authority in %q", ErrInvalidTarget, target)
+	}
+	parsed := Target{Form: TargetAbsolute, Scheme: strings.ToLower(scheme), Host: host}
+	return parsed, parsed.parsePathQuery(path_query)
+}
+
+func (t *Target) parsePathQuery(path_query string) error {
+	raw_path, raw_query, _ := strings.Cut(path_query, "?")
+	path, err := url.PathUnescape(raw_path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+	}
+	t.Path, t.RawPath, t.RawQuery, t.Query = path, raw_path, raw_query, parseQuery(raw_query)
+	return nil
+}
+
+// parseQuery decodes a query of "&" separated key=value pairs. Unlike
+// url.ParseQuery it never fails: RFC 3986 leaves the syntax of a query to
+// the resource, so a pair that does not decode, or holds a ";", is kept as
+// sent for the handler, which may not even look at the query, to make sense
+// of.
+func parseQuery(raw_query string) url.Values {
+	query := make(url.Values)
+	for pair := range strings.SplitSeq(raw_query, "&") {
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, "=")
+		query.Add(unescapeQuery(key), unescapeQuery(value))
+	}
+	return query
+}
+
+func unescapeQuery(s string) string {
+	unescaped, err := url.QueryUnescape(s)
+	if err != nil {
+		return s
+	}
+	return unescaped
+}
+
+// isScheme reports whether s is an RFC 3986 scheme, a letter followed by
+// letters, digits, "+", "-" or ".".
+func isScheme(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		letter := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+		if !letter && (i == 0 || !(r >= '0' && r <= '9' || r == '+' || r == '-' || r == '.')) {
+			return false
+		}
+	}
+	return true
+}
+
+// isAuthority reports whether s is a host followed by a port, with no path or
+// userinfo, as required of a CONNECT target.
+func isAuthority(s string) bool {
+	i := strings.LastIndexByte(s, ':')
+	if i <= 0 || i == len(s)-1 || strings.ContainsAny(s, "/?@") {
+		return false
+	}
+	for _, r := range s[i+1:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
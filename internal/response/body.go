@@ -0,0 +1,169 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"strconv"
+)
+
+// ErrContentLength is returned when a body does not match the Content-Length
+// its headers declared.
+var ErrContentLength = errors.New("body does not match Content-Length")
+
+// bodyBufferSize is how much of a body BodyWriter holds back to be able to
+// send it with a Content-Length.
+const bodyBufferSize = 4096
+
+// BodyWriter writes a response for a handler that does not want to work out
+// its framing. A body that fits in a small buffer by the time Close is called
+// goes out with a Content-Length, one that outgrows the buffer or is flushed
+// early is switched to chunked encoding. A Content-Length set by the handler
+// is kept and enforced instead.
+type BodyWriter struct {
+	w          *Writer
+	statusCode StatusCode
+	header     *headers.Headers
+	buf        []byte
+	// length is the declared Content-Length, -1 if there is none
+	length  int64
+	written int64
+	chunked bool
+	started bool
+	closed  bool
+}
+
+// NewBodyWriter returns a BodyWriter answering with statusCode and h on w.
+// Nothing is written until the first Write, Flush or Close.
+func NewBodyWriter(w *Writer, statusCode StatusCode, h *headers.Headers) (*BodyWriter, error) {
+	b := &BodyWriter{w: w, statusCode: statusCode, header: h, length: -1}
+	if v, ok := h.Get("Content-Length"); ok {
+		length, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("%w: invalid value %q", ErrContentLength, v)
+		}
+		b.length = length
+	}
+	b.chunked = h.HasToken("Transfer-Encoding", "chunked")
+	return b, nil
+}
+
+// Write sends p as part of the body, or holds it back while the body is
+// small enough to still be sent with a Content-Length.
+func (b *BodyWriter) Write(p []byte) (int, error) {
+	if b.closed {
+		return 0, errors.New("error: writing to a closed body")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if !bodyAllowed(b.statusCode) {
+		return 0, fmt.Errorf("error: writing body of a %d response", b.statusCode)
+	}
+	switch {
+	case b.length >= 0:
+		if b.written+int64(len(p)) > b.length {
+			return 0, fmt.Errorf("%w: writing past %d bytes", ErrContentLength, b.length)
+		}
+		if err := b.writeHead(); err != nil {
+			return 0, err
+		}
+		n, err := b.w.Write(p)
+		b.written += int64(n)
+		return n, err
+	case b.chunked:
+		if err := b.writeHead(); err != nil {
+			return 0, err
+		}
+		return b.writeChunk(p)
+	case len(b.buf)+len(p) <= bodyBufferSize:
+		b.buf = append(b.buf, p...)
+		return len(p), nil
+	}
+	if err := b.startChunked(); err != nil {
+		return 0, err
+	}
+	return b.writeChunk(p)
+}
+
+// Flush sends the status line, headers and any body held back so far,
+// committing a body of unknown length to chunked encoding.
+func (b *BodyWriter) Flush() error {
+	if b.closed {
+		return nil
+	}
+	var err error
+	if b.length < 0 && !b.chunked && bodyAllowed(b.statusCode) {
+		err = b.startChunked()
+	} else {
+		err = b.writeHead()
+	}
+	if err != nil {
+		return err
+	}
+	return b.w.Flush()
+}
+
+// Close finishes the response. It fails with ErrContentLength if fewer bytes
+// were written than declared, in which case the response is cut short and
+// the connection marked to be closed.
+func (b *BodyWriter) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if !b.started && b.length < 0 && !b.chunked && bodyAllowed(b.statusCode) {
+		b.header.Set("Content-Length", strconv.Itoa(len(b.buf)))
+		if err := b.writeHead(); err != nil {
+			return err
+		}
+		_, err := b.w.Write(b.buf)
+		return err
+	}
+	if err := b.writeHead(); err != nil {
+		return err
+	}
+	if b.chunked {
+		return b.w.WriteChunkedBodyDone(nil)
+	}
+	if b.length >= 0 && b.written < b.length && bodyAllowed(b.statusCode) {
+		b.w.SetClose()
+		return fmt.Errorf("%w: wrote %d of %d bytes", ErrContentLength, b.written, b.length)
+	}
+	return nil
+}
+
+func (b *BodyWriter) writeHead() error {
+	if b.started {
+		return nil
+	}
+	b.started = true
+	if err := b.w.WriteStatusLine(b.statusCode); err != nil {
+		return err
+	}
+	return b.w.WriteHeaders(b.header)
+}
+
+// startChunked sends the headers of a chunked body along with what was held
+// back of it.
+func (b *BodyWriter) startChunked() error {
+	b.chunked = true
+	b.header.Set("Transfer-Encoding", "chunked")
+	if err := b.writeHead(); err != nil {
+		return err
+	}
+	if len(b.buf) == 0 {
+		return nil
+	}
+	_, err := b.writeChunk(b.buf)
+	b.buf = nil
+	return err
+}
+
+// writeChunk writes p as a chunk, returning how much of p was written.
+func (b *BodyWriter) writeChunk(p []byte) (int, error) {
+	if _, err := b.w.WriteChunkedBody(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,30 @@
+package response
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TimeFormat is the IMF-fixdate format of HTTP dates, always in GMT.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+type cachedDate struct {
+	unix  int64
+	value string
+}
+
+// lastDate holds the Date value of the current second, shared by the
+// responses written within it.
+var lastDate atomic.Pointer[cachedDate]
+
+// httpDate returns now formatted as an HTTP date, formatting it only once per
+// second.
+func httpDate(now time.Time) string {
+	unix := now.Unix()
+	if cached := lastDate.Load(); cached != nil && cached.unix == unix {
+		return cached.value
+	}
+	value := now.UTC().Format(TimeFormat)
+	lastDate.Store(&cachedDate{unix: unix, value: value})
+	return value
+}
@@ -1,18 +1,58 @@
 package response
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
-type StatusCode int
+// ErrInvalidTrailer is returned for a trailer field that may not be sent.
+var ErrInvalidTrailer = errors.New("invalid trailer")
 
-const (
-	Status200 StatusCode = 200
-	Status400 StatusCode = 400
-	Status500 StatusCode = 500
-)
+// forbiddenTrailers are the fields RFC 9110 keeps out of trailers, as they
+// frame, route or control the message and must be known before the body.
+var forbiddenTrailers = map[string]bool{
+	"Age":                 true,
+	"Authorization":       true,
+	"Cache-Control":       true,
+	"Connection":          true,
+	"Content-Encoding":    true,
+	"Content-Length":      true,
+	"Content-Range":       true,
+	"Content-Type":        true,
+	"Cookie":              true,
+	"Date":                true,
+	"Expect":              true,
+	"Expires":             true,
+	"Host":                true,
+	"If-Match":            true,
+	"If-Modified-Since":   true,
+	"If-None-Match":       true,
+	"If-Range":            true,
+	"If-Unmodified-Since": true,
+	"Keep-Alive":          true,
+	"Location":            true,
+	"Max-Forwards":        true,
+	"Pragma":              true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Range":               true,
+	"Retry-After":         true,
+	"Set-Cookie":          true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Vary":                true,
+	"Www-Authenticate":    true,
+}
 
 type writerState int
 
@@ -23,45 +63,101 @@ const (
   writerBodyWritten
 )
 
+// httpVersion is the protocol version of every response. HTTP/1.0 clients
+// get it too, restricted to what they understand, as RFC 9110 has servers
+// answer with the highest minor version they support.
+const httpVersion = "HTTP/1.1"
+
 type Writer struct {
-  writer        io.Writer
+  // writer buffers what is written to conn until Flush
+  writer        *bufio.Writer
+  conn          io.Writer
   writerState   writerState
+  statusCode    StatusCode
+  closeConn     bool
+  // http10 is set for a request from an HTTP/1.0 client, which knows
+  // neither chunked bodies nor persistent connections by default
+  http10        bool
+  // unchunked is set once a chunked body has been turned into one delimited
+  // by closing the connection for an HTTP/1.0 client
+  unchunked     bool
+  // chunked is set when the body is sent in chunks
+  chunked       bool
+  // trailers are the names announced in the Trailer header
+  trailers      []string
+  // head is set for a response to a HEAD request, which carries the headers
+  // of the response to a GET but no body
+  head          bool
+  // server is the value of the Server header, none if empty
+  server        string
+  // onHeaders are called on the headers of the final response before they
+  // are written
+  onHeaders     []func(statusCode StatusCode, h *headers.Headers)
+  // onFinish are called once by Finish
+  onFinish      []func()
+  bodyBytes     int64
+  // contentLength is the length the headers declared for the body, -1 if
+  // they declared none or the body is not sent
+  contentLength int64
 }
 
 func NewWriter(w io.Writer) *Writer {
-  return &Writer{ writer: w, writerState: writerInitialized }
+  return &Writer{ writer: bufio.NewWriter(w), conn: w, writerState: writerInitialized, contentLength: -1 }
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+  return w.WriteStatusLineReason(statusCode, StatusText(statusCode))
+}
+
+// WriteStatusLineReason writes a status line with a reason phrase of the
+// handler's choosing instead of the registered one.
+func (w *Writer) WriteStatusLineReason(statusCode StatusCode, reasonPhrase string) error {
   if w.writerState != writerInitialized {
     return fmt.Errorf("error: writing status line in state %d", w.writerState)
   }
-  reasonPhrase := ""
-	switch statusCode {
-	case Status200:
-    reasonPhrase = "OK"
-	case Status400:
-    reasonPhrase = "Bad Request"
-	case Status500:
-    reasonPhrase = "Internal Server Error"
-  default:
-    reasonPhrase = ""
-	}
-  _, err := fmt.Fprintf(w.writer, "HTTP/1.1 %d %s\r\n", statusCode, reasonPhrase)
+  if statusCode < 100 || statusCode > 999 {
+    return fmt.Errorf("error: invalid status code %d", statusCode)
+  }
+  if !validReasonPhrase(reasonPhrase) {
+    return fmt.Errorf("error: invalid reason phrase %q", reasonPhrase)
+  }
+  // RFC 9110 keeps interim responses from HTTP/1.0 clients, which would take
+  // them for the final one
+  if informational(statusCode) && w.http10 {
+    if statusCode == Status101 {
+      return fmt.Errorf("error: switching protocols of an HTTP/1.0 request")
+    }
+    w.statusCode = statusCode
+    w.writerState = writerStatusLineWritten
+    return nil
+  }
+  _, err := fmt.Fprintf(w.writer, "%s %d %s\r\n", httpVersion, statusCode, reasonPhrase)
+  w.statusCode = statusCode
   w.writerState = writerStatusLineWritten
 	return err
 }
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
+// validReasonPhrase reports whether reasonPhrase is made of the tabs, spaces,
+// visible characters and obs-text RFC 9112 allows there.
+func validReasonPhrase(reasonPhrase string) bool {
+	for i := 0; i < len(reasonPhrase); i++ {
+		c := reasonPhrase[i]
+		if c != '\t' && (c < ' ' || c == 0x7f) {
+			return false
+		}
+	}
+	return true
+}
+
+func GetDefaultHeaders(contentLen int) *headers.Headers {
 	headers := headers.NewHeaders()
-	headers["Content-Length"] = fmt.Sprintf("%d", contentLen)
-	headers["Connection"] = "close"
-	headers["Content-Type"] = "text/plain"
+	headers.Set("Content-Length", fmt.Sprintf("%d", contentLen))
+	headers.Set("Content-Type", "text/plain")
 	return headers
 }
 
-func (w *Writer) writeHeaders(headers headers.Headers) error {
-	for key, val := range headers {
+func (w *Writer) writeHeaders(headers *headers.Headers) error {
+	for key, val := range headers.All() {
 		_, err := fmt.Fprintf(w.writer, "%s: %s\r\n", key, val)
 		if err != nil {
 			return err
@@ -71,39 +167,313 @@ func (w *Writer) writeHeaders(headers headers.Headers) error {
   return err
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+// SetClose marks the connection to be closed once this response is written.
+// WriteHeaders then advertises it with a Connection: close header.
+func (w *Writer) SetClose() {
+	w.closeConn = true
+}
+
+// Closing reports whether the connection is to be closed after this response,
+// either because SetClose was called or the handler sent Connection: close.
+func (w *Writer) Closing() bool {
+	return w.closeConn
+}
+
+// Started reports whether any part of the final response has been written,
+// interim 1xx responses do not count.
+func (w *Writer) Started() bool {
+	return w.writerState != writerInitialized
+}
+
+// Done reports whether a complete response has been written, that is the
+// connection is in a state where another response may follow. A chunked body
+// is only complete once it has been ended, and one with a Content-Length once
+// that many bytes have been written.
+func (w *Writer) Done() bool {
+	if w.chunked && !w.head {
+		return w.writerState == writerBodyWritten
+	}
+	if w.contentLength >= 0 && w.bodyBytes != w.contentLength {
+		return false
+	}
+	return w.writerState == writerHeadersWritten || w.writerState == writerBodyWritten
+}
+
+// SetRequestVersion tells the writer the HTTP version of the request being
+// answered, such as "1.0", so the response only uses what the client knows.
+func (w *Writer) SetRequestVersion(version string) {
+	w.http10 = version == "1.0"
+}
+
+// OnHeaders registers fn to be called with the status code and headers of
+// the final response just before WriteHeaders writes them, letting it change
+// them. Hooks are called in the order they were registered.
+func (w *Writer) OnHeaders(fn func(statusCode StatusCode, h *headers.Headers)) {
+	w.onHeaders = append(w.onHeaders, fn)
+}
+
+// OnFinish registers fn to be called by Finish, once the response is over.
+// Hooks are called in the order they were registered.
+func (w *Writer) OnFinish(fn func()) {
+	w.onFinish = append(w.onFinish, fn)
+}
+
+// Finish calls the hooks registered with OnFinish, the first time only. The
+// server calls it once it is through with the response, including any it
+// writes itself for an error the handler returned, so StatusCode and
+// BodyBytes then describe what was actually sent.
+func (w *Writer) Finish() {
+	hooks := w.onFinish
+	w.onFinish = nil
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+// StatusCode returns the status code of the last status line written, 0 if
+// there is none yet.
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// BodyBytes returns how many bytes of body have been sent, not counting the
+// framing of chunks.
+func (w *Writer) BodyBytes() int64 {
+	return w.bodyBytes
+}
+
+// SetServer sets the Server header WriteHeaders adds to responses, naming
+// the software that wrote them. It is empty, adding none, by default.
+func (w *Writer) SetServer(server string) {
+	w.server = server
+}
+
+// SetRequestMethod tells the writer the method of the request being answered.
+// The body of a response to HEAD is dropped, leaving handlers free to write
+// it as they would for GET so the headers describe it.
+func (w *Writer) SetRequestMethod(method string) {
+	w.head = method == "HEAD"
+}
+
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
   if w.writerState != writerStatusLineWritten {
     return fmt.Errorf("error: writing headers in state %d", w.writerState)
   }
-  err := w.writeHeaders(headers)
+  if informational(w.statusCode) && w.http10 {
+    // the status line was dropped, so are the headers
+    w.writerState = writerInitialized
+    return nil
+  }
+  if !informational(w.statusCode) {
+    for _, fn := range w.onHeaders {
+      fn(w.statusCode, h)
+    }
+  }
+  w.trailers = nil
+  for _, list := range h.Values("Trailer") {
+    for name := range strings.SplitSeq(list, ",") {
+      name = headers.CanonicalName(strings.TrimSpace(name))
+      if forbiddenTrailers[name] {
+        return fmt.Errorf("%w: %s may not be sent as a trailer", ErrInvalidTrailer, name)
+      }
+      if name != "" {
+        w.trailers = append(w.trailers, name)
+      }
+    }
+  }
+  // an interim response says nothing of the connection, the final one does
+  if h.HasToken("Connection", "close") && !informational(w.statusCode) {
+    w.closeConn = true
+  }
+  // close and keep-alive are the writer's to decide, other options such as
+  // Upgrade are the handler's
+  var connection []string
+  for _, list := range h.Values("Connection") {
+    for option := range strings.SplitSeq(list, ",") {
+      option = strings.TrimSpace(option)
+      if option != "" && !strings.EqualFold(option, "close") && !strings.EqualFold(option, "keep-alive") {
+        connection = append(connection, option)
+      }
+    }
+  }
+  h.Del("Connection")
+  if w.http10 && !informational(w.statusCode) {
+    // without chunked encoding, the end of a body of unknown length can only
+    // be told by the connection closing
+    if h.HasToken("Transfer-Encoding", "chunked") {
+      h.Del("Transfer-Encoding")
+      h.Del("Trailer")
+      w.unchunked = true
+    }
+    if _, ok := h.Get("Content-Length"); !ok {
+      w.closeConn = true
+    }
+  }
+  if w.statusCode == Status204 || informational(w.statusCode) {
+    h.Del("Content-Length")
+    h.Del("Transfer-Encoding")
+  }
+  // interim responses need no Date, the final one carries it
+  date := ""
+  if !informational(w.statusCode) {
+    date = httpDate(time.Now())
+  }
+  setDefault(h, "Date", date)
+  setDefault(h, "Server", w.server)
+  w.chunked = h.HasToken("Transfer-Encoding", "chunked")
+  w.contentLength = -1
+  if v, ok := h.Get("Content-Length"); ok && !w.chunked && !w.head && bodyAllowed(w.statusCode) {
+    length, err := strconv.ParseInt(v, 10, 64)
+    if err != nil || length < 0 {
+      return fmt.Errorf("%w: invalid value %q", ErrContentLength, v)
+    }
+    w.contentLength = length
+  }
+  // only options such as Upgrade go in an interim response
+  if !informational(w.statusCode) {
+    if w.closeConn {
+      connection = append(connection, "close")
+    } else if w.http10 {
+      connection = append(connection, "keep-alive")
+    }
+  }
+  if len(connection) > 0 {
+    h.Set("Connection", strings.Join(connection, ", "))
+  }
+  err := w.writeHeaders(h)
   w.writerState = writerHeadersWritten
+  // the final response to the request is still to follow an interim one,
+  // which the client may be waiting on this one to send
+  if informational(w.statusCode) {
+    if w.statusCode != Status101 {
+      w.writerState = writerInitialized
+    }
+    if err == nil {
+      err = w.writer.Flush()
+    }
+  }
   return err
 }
 
-func (w *Writer) WriteTrailers(trailers headers.Headers) error {
-  if w.writerState != writerBodyWritten {
-    return fmt.Errorf("error: writing trailers in state %d", w.writerState)
+// Write sends p as part of the body, in a chunk of its own if the headers
+// declared a chunked body. It may be called any number of times.
+func (w *Writer) Write(p []byte) (int, error) {
+  if err := w.checkBody(); err != nil {
+    return 0, err
   }
-  err := w.writeHeaders(trailers)
-  if err != nil {
-    return err
+  if len(p) == 0 {
+    return 0, nil
   }
-  _, err = w.writer.Write([]byte("\r\n"))
-  return err
+  if !bodyAllowed(w.statusCode) {
+    return 0, fmt.Errorf("error: writing body of a %d response", w.statusCode)
+  }
+  if w.head {
+    return len(p), nil
+  }
+  if w.chunked {
+    // report only p as written, not the framing around it
+    if _, err := w.WriteChunkedBody(p); err != nil {
+      return 0, err
+    }
+    return len(p), nil
+  }
+  if w.contentLength >= 0 && w.bodyBytes+int64(len(p)) > w.contentLength {
+    return 0, fmt.Errorf("%w: writing past %d bytes", ErrContentLength, w.contentLength)
+  }
+  w.setBodyWritten()
+  n, err := w.writer.Write(p)
+  w.bodyBytes += int64(n)
+  return n, err
 }
 
+// WriteBody is Write, kept for handlers written against the one-shot API.
 func (w *Writer) WriteBody(p []byte) (int, error) {
-  if w.writerState != writerHeadersWritten {
-    return 0, fmt.Errorf("error: writing body in state %d", w.writerState)
+  return w.Write(p)
+}
+
+// ReadFrom sends what is read from r until EOF as part of the body. It is
+// what io.Copy calls, directly or through the WriteTo of an *os.File. A body
+// that is not chunked is handed straight to the connection, which for TCP
+// sends a file with sendfile. For HEAD nothing is read from r, the body
+// would only be dropped.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+  if err := w.checkBody(); err != nil {
+    return 0, err
   }
-  w.writerState = writerBodyWritten
-  return w.writer.Write(p)
+  if w.head {
+    return 0, nil
+  }
+  if rf, ok := w.conn.(io.ReaderFrom); ok && !w.chunked && !w.head && bodyAllowed(w.statusCode) {
+    if err := w.writer.Flush(); err != nil {
+      return 0, err
+    }
+    w.setBodyWritten()
+    if w.contentLength < 0 {
+      n, err := rf.ReadFrom(r)
+      w.bodyBytes += n
+      return n, err
+    }
+    // the connection still sends a file limited this way with sendfile
+    n, err := rf.ReadFrom(io.LimitReader(r, w.contentLength-w.bodyBytes))
+    w.bodyBytes += n
+    if err != nil || w.bodyBytes < w.contentLength {
+      return n, err
+    }
+    if m, _ := r.Read(make([]byte, 1)); m > 0 {
+      return n, fmt.Errorf("%w: writing past %d bytes", ErrContentLength, w.contentLength)
+    }
+    return n, nil
+  }
+  return io.Copy(writerOnly{w}, r)
+}
+
+// writerOnly hides ReadFrom from io.Copy, which would otherwise call it back.
+type writerOnly struct {
+  io.Writer
+}
+
+// Flush sends whatever has been written so far to the connection.
+func (w *Writer) Flush() error {
+  return w.writer.Flush()
+}
+
+// setBodyWritten records that a body delimited by Content-Length or by
+// closing the connection has been started. A chunked body, even one that is
+// not sent in chunks, is only over once WriteChunkedBodyDone ends it.
+func (w *Writer) setBodyWritten() {
+  if !w.unchunked {
+    w.writerState = writerBodyWritten
+  }
+}
+
+// checkBody returns an error unless the headers have been written and the
+// body has not been ended.
+func (w *Writer) checkBody() error {
+  if w.writerState != writerHeadersWritten && (w.writerState != writerBodyWritten || w.chunked || w.unchunked) {
+    return fmt.Errorf("error: writing body in state %d", w.writerState)
+  }
+  return nil
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
   if w.writerState != writerHeadersWritten {
     return 0, fmt.Errorf("error: writing body in state %d", w.writerState)
   }
+  if !bodyAllowed(w.statusCode) {
+    return 0, fmt.Errorf("error: writing body of a %d response", w.statusCode)
+  }
+  if len(p) == 0 {
+    // an empty chunk would end the body
+    return 0, nil
+  }
+  if w.head {
+    return len(p), nil
+  }
+  if w.unchunked {
+    n, err := w.writer.Write(p)
+    w.bodyBytes += int64(n)
+    return n, err
+  }
   chunkSizeHex := fmt.Sprintf("%X", len(p))
   nTotal := 0
   n, err := w.writer.Write([]byte(chunkSizeHex + "\r\n"))
@@ -113,6 +483,7 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
   nTotal += n
 
   n, err = w.writer.Write(p)
+  w.bodyBytes += int64(n)
   if err != nil {
     return nTotal, err
   }
@@ -125,11 +496,52 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
   nTotal += n
   return nTotal, nil
 }
-func (w *Writer) WriteChunkedBodyDone() (int, error) {
-  if w.writerState != writerHeadersWritten {
-    return 0, fmt.Errorf("error: writing body in state %d", w.writerState)
+
+// WriteChunkedBodyDone ends a chunked body with the last chunk followed by
+// trailers, which may be nil for none. Each trailer must have been announced
+// in the Trailer header and be a field allowed after the body.
+func (w *Writer) WriteChunkedBodyDone(trailers *headers.Headers) error {
+  if w.writerState != writerHeadersWritten || !(w.chunked || w.unchunked) {
+    return fmt.Errorf("error: ending chunked body in state %d", w.writerState)
+  }
+  if trailers == nil {
+    trailers = headers.NewHeaders()
+  }
+  for name := range trailers.All() {
+    if err := w.checkTrailer(name); err != nil {
+      return err
+    }
   }
-  n, err := w.writer.Write([]byte("0\r\n"))
   w.writerState = writerBodyWritten
-  return n, err
+  // an HTTP/1.0 client is not sent chunks, and so no trailers either
+  if w.unchunked || w.head {
+    return nil
+  }
+  if _, err := w.writer.Write([]byte("0\r\n")); err != nil {
+    return err
+  }
+  return w.writeHeaders(trailers)
+}
+
+// setDefault sets the field key of h to value unless the handler set it
+// already. A handler suppresses the field by setting it to the empty string.
+func setDefault(h *headers.Headers, key, value string) {
+	v, ok := h.Get(key)
+	switch {
+	case !ok && value != "":
+		h.Set(key, value)
+	case ok && v == "":
+		h.Del(key)
+	}
+}
+
+// checkTrailer returns an error unless a trailer named name may be sent.
+func (w *Writer) checkTrailer(name string) error {
+  if forbiddenTrailers[name] {
+    return fmt.Errorf("%w: %s may not be sent as a trailer", ErrInvalidTrailer, name)
+  }
+  if !slices.Contains(w.trailers, name) {
+    return fmt.Errorf("%w: %s was not announced in the Trailer header", ErrInvalidTrailer, name)
+  }
+  return nil
 }
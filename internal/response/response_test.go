@@ -0,0 +1,644 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/headers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stripDate removes the Date field, which changes by the second, from a
+// written response
+func stripDate(s string) string {
+	return dateField.ReplaceAllString(s, "")
+}
+
+var dateField = regexp.MustCompile(`Date: [^\r]*\r\n`)
+
+func TestWriteStatusLine(t *testing.T) {
+	// Test: Registered status code gets its reason phrase
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status404))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\n", stripDate(buf.String()))
+
+	// Test: Unregistered status code gets an empty reason phrase
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusCode(599)))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 599 \r\n", stripDate(buf.String()))
+
+	// Test: Custom reason phrase
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLineReason(Status200, "All Good"))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 All Good\r\n", stripDate(buf.String()))
+
+	// Test: Reason phrase with a line break
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.Error(t, w.WriteStatusLineReason(Status200, "OK\r\nX-Injected: 1"))
+	require.NoError(t, w.Flush())
+	assert.Empty(t, buf.String())
+
+	// Test: Status code out of range
+	w = NewWriter(&buf)
+	require.Error(t, w.WriteStatusLine(StatusCode(42)))
+	require.Error(t, w.WriteStatusLine(StatusCode(1000)))
+	require.NoError(t, w.Flush())
+	assert.Empty(t, buf.String())
+}
+
+func TestStatusText(t *testing.T) {
+	assert.Equal(t, "OK", StatusText(Status200))
+	assert.Equal(t, "Content Too Large", StatusText(Status413))
+	assert.Equal(t, "Network Authentication Required", StatusText(Status511))
+	assert.Equal(t, "", StatusText(StatusCode(299)))
+}
+
+func TestBodylessStatus(t *testing.T) {
+	// Test: 204 response drops its framing headers and refuses a body
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status204))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	require.NoError(t, w.Flush())
+	assert.NotContains(t, stripDate(buf.String()), "Content-Length")
+	_, err := w.WriteBody([]byte("hello"))
+	require.Error(t, err)
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.Error(t, err)
+	assert.True(t, w.Done())
+
+	// Test: 304 response keeps Content-Length but refuses a body
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status304))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	require.NoError(t, w.Flush())
+	assert.Contains(t, stripDate(buf.String()), "Content-Length: 5\r\n")
+	_, err = w.WriteBody([]byte("hello"))
+	require.Error(t, err)
+	_, err = w.WriteBody(nil)
+	require.NoError(t, err)
+
+	// Test: Interim 1xx response is followed by the final one
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status100))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	assert.False(t, w.Done())
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(2)))
+	_, err = w.WriteBody([]byte("ok"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Type: text/plain\r\n\r\nok", stripDate(buf.String()))
+}
+
+func TestBodyWriter(t *testing.T) {
+	// Test: Small body is sent with a Content-Length
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	body, err := NewBodyWriter(w, Status200, h)
+	require.NoError(t, err)
+	_, err = body.Write([]byte("hello, "))
+	require.NoError(t, err)
+	_, err = body.Write([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Empty(t, buf.String())
+	require.NoError(t, body.Close())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 12\r\n\r\nhello, world", stripDate(buf.String()))
+	assert.True(t, w.Done())
+
+	// Test: Empty body
+	buf.Reset()
+	w = NewWriter(&buf)
+	body, err = NewBodyWriter(w, Status404, headers.NewHeaders())
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n", stripDate(buf.String()))
+
+	// Test: Body outgrowing the buffer is switched to chunked encoding
+	buf.Reset()
+	w = NewWriter(&buf)
+	body, err = NewBodyWriter(w, Status200, headers.NewHeaders())
+	require.NoError(t, err)
+	_, err = body.Write([]byte("abc"))
+	require.NoError(t, err)
+	big := bytes.Repeat([]byte("x"), bodyBufferSize)
+	_, err = body.Write(big)
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"3\r\nabc\r\n1000\r\n"+string(big)+"\r\n0\r\n\r\n", stripDate(buf.String()))
+
+	// Test: Flush commits to chunked encoding
+	buf.Reset()
+	w = NewWriter(&buf)
+	body, err = NewBodyWriter(w, Status200, headers.NewHeaders())
+	require.NoError(t, err)
+	_, err = body.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, body.Flush())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n", stripDate(buf.String()))
+	_, err = body.Write([]byte("de"))
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n2\r\nde\r\n0\r\n\r\n", stripDate(buf.String()))
+
+	// Test: Declared Content-Length is streamed and kept
+	buf.Reset()
+	w = NewWriter(&buf)
+	h = headers.NewHeaders()
+	h.Set("Content-Length", "5")
+	body, err = NewBodyWriter(w, Status200, h)
+	require.NoError(t, err)
+	_, err = body.Write([]byte("hel"))
+	require.NoError(t, err)
+	_, err = body.Write([]byte("lo"))
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", stripDate(buf.String()))
+	assert.False(t, w.Closing())
+
+	// Test: Writing past the declared Content-Length
+	buf.Reset()
+	w = NewWriter(&buf)
+	h = headers.NewHeaders()
+	h.Set("Content-Length", "3")
+	body, err = NewBodyWriter(w, Status200, h)
+	require.NoError(t, err)
+	n, err := body.Write([]byte("hello"))
+	require.ErrorIs(t, err, ErrContentLength)
+	assert.Equal(t, 0, n)
+
+	// Test: Writing short of the declared Content-Length
+	buf.Reset()
+	w = NewWriter(&buf)
+	h = headers.NewHeaders()
+	h.Set("Content-Length", "5")
+	body, err = NewBodyWriter(w, Status200, h)
+	require.NoError(t, err)
+	_, err = body.Write([]byte("hi"))
+	require.NoError(t, err)
+	require.ErrorIs(t, body.Close(), ErrContentLength)
+	assert.True(t, w.Closing())
+
+	// Test: Invalid declared Content-Length
+	h = headers.NewHeaders()
+	h.Set("Content-Length", "-1")
+	_, err = NewBodyWriter(NewWriter(&buf), Status200, h)
+	require.ErrorIs(t, err, ErrContentLength)
+
+	// Test: 204 response gets no Content-Length and refuses a body
+	buf.Reset()
+	w = NewWriter(&buf)
+	body, err = NewBodyWriter(w, Status204, headers.NewHeaders())
+	require.NoError(t, err)
+	_, err = body.Write([]byte("x"))
+	require.Error(t, err)
+	require.NoError(t, body.Close())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", stripDate(buf.String()))
+
+	// Test: HTTP/1.0 client gets a body too large to buffer without chunks
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestVersion("1.0")
+	body, err = NewBodyWriter(w, Status200, headers.NewHeaders())
+	require.NoError(t, err)
+	_, err = body.Write([]byte("abc"))
+	require.NoError(t, err)
+	_, err = body.Write(big)
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nabc"+string(big), stripDate(buf.String()))
+}
+
+func TestWriterStreaming(t *testing.T) {
+	// Test: Body written in several calls
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(11)))
+	_, err := fmt.Fprintf(w, "hello")
+	require.NoError(t, err)
+	_, err = w.Write([]byte(" world"))
+	require.NoError(t, err)
+	assert.Empty(t, buf.String())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 11\r\nContent-Type: text/plain\r\n\r\nhello world", stripDate(buf.String()))
+
+	// Test: Writes to a chunked body become chunks
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status200))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = io.Copy(w, strings.NewReader("hello"))
+	require.NoError(t, err)
+	_, err = w.Write(nil)
+	require.NoError(t, err)
+	assert.False(t, w.Done())
+	require.NoError(t, w.WriteChunkedBodyDone(nil))
+	assert.True(t, w.Done())
+	_, err = w.Write([]byte("late"))
+	require.Error(t, err)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", stripDate(buf.String()))
+
+	// Test: Copying a file into the body
+	f, err := os.CreateTemp(t.TempDir(), "body")
+	require.NoError(t, err)
+	_, err = f.WriteString("file contents")
+	require.NoError(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(13)))
+	n, err := w.ReadFrom(f)
+	require.NoError(t, err)
+	assert.Equal(t, int64(13), n)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 13\r\nContent-Type: text/plain\r\n\r\nfile contents", stripDate(buf.String()))
+
+	// Test: io.Copy from a file reaches the connection, through the WriteTo
+	// of the file
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	var out bytes.Buffer
+	conn := &readerFromConn{Writer: &out}
+	w = NewWriter(conn)
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(13)))
+	n, err = io.Copy(w, f)
+	require.NoError(t, err)
+	assert.Equal(t, int64(13), n)
+	assert.Equal(t, 1, conn.readFromCalls)
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\nfile contents"))
+	assert.True(t, w.Done())
+
+	// Test: Writing the body before the headers
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status200))
+	_, err = w.Write([]byte("early"))
+	require.Error(t, err)
+}
+
+func TestWriteConnection(t *testing.T) {
+	// Test: Upgrade survives in the Connection header of a 101
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status101))
+	h := headers.NewHeaders()
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "websocket")
+	require.NoError(t, w.WriteHeaders(h))
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", buf.String())
+
+	// Test: Interim response leaves the closing to the final one
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetClose()
+	require.NoError(t, w.WriteStatusLine(Status100))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", buf.String())
+
+	// Test: Interim responses are dropped for HTTP/1.0, and 101 refused
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestVersion("1.0")
+	require.NoError(t, w.WriteStatusLine(Status103))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.Error(t, w.WriteStatusLine(Status101))
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.False(t, w.Closing())
+
+	// Test: Other options are kept next to the close the writer decides on
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetClose()
+	require.NoError(t, w.WriteStatusLine(Status200))
+	h = GetDefaultHeaders(0)
+	h.Set("Connection", "keep-alive, X-Hop")
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Flush())
+	assert.Contains(t, buf.String(), "\r\nConnection: X-Hop, close\r\n")
+
+	// Test: A lone keep-alive goes away for HTTP/1.1
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status200))
+	h = GetDefaultHeaders(0)
+	h.Set("Connection", "Keep-Alive")
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Flush())
+	assert.NotContains(t, buf.String(), "Connection")
+	assert.False(t, w.Closing())
+}
+
+func TestWriteContentLength(t *testing.T) {
+	// Test: Response is only done once the declared length is written
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(10)))
+	_, err := w.Write([]byte("abc"))
+	require.NoError(t, err)
+	assert.False(t, w.Done())
+	_, err = w.Write([]byte("defghij"))
+	require.NoError(t, err)
+	assert.True(t, w.Done())
+
+	// Test: Writing past the declared length fails without writing
+	n, err := w.Write([]byte("k"))
+	require.ErrorIs(t, err, ErrContentLength)
+	assert.Equal(t, 0, n)
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nabcdefghij"))
+
+	// Test: A file longer than the declared length is cut at it
+	var out bytes.Buffer
+	conn := &readerFromConn{Writer: &out}
+	w = NewWriter(conn)
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(4)))
+	file, err := os.CreateTemp(t.TempDir(), "body")
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = file.WriteString("hello")
+	require.NoError(t, err)
+	_, err = file.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	_, err = w.ReadFrom(file)
+	require.ErrorIs(t, err, ErrContentLength)
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\nhell"))
+	assert.True(t, w.Done())
+
+	// Test: Declared length means nothing for HEAD
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(10)))
+	assert.True(t, w.Done())
+}
+
+// readerFromConn is a connection that, like a TCP one, takes a file to send
+// through ReadFrom
+type readerFromConn struct {
+	io.Writer
+	readFromCalls int
+}
+
+func (c *readerFromConn) ReadFrom(r io.Reader) (int64, error) {
+	c.readFromCalls++
+	return io.Copy(c.Writer, r)
+}
+
+func TestWriteTrailers(t *testing.T) {
+	chunkedHeaders := func(trailer string) *headers.Headers {
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		if trailer != "" {
+			h.Set("Trailer", trailer)
+		}
+		return h
+	}
+
+	// Test: Announced trailers follow the last chunk
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(chunkedHeaders("x-checksum, X-Length")))
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	trailers.Set("X-Length", "5")
+	require.NoError(t, w.WriteChunkedBodyDone(trailers))
+	assert.True(t, w.Done())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: x-checksum, X-Length\r\n\r\n"+
+		"5\r\nhello\r\n0\r\nX-Checksum: abc\r\nX-Length: 5\r\n\r\n", stripDate(buf.String()))
+
+	// Test: Ending a body without trailers
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(chunkedHeaders("")))
+	require.NoError(t, w.WriteChunkedBodyDone(nil))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", stripDate(buf.String()))
+	require.Error(t, w.WriteChunkedBodyDone(nil))
+
+	// Test: Trailer that was not announced
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(chunkedHeaders("X-Checksum")))
+	trailers = headers.NewHeaders()
+	trailers.Set("X-Other", "1")
+	require.ErrorIs(t, w.WriteChunkedBodyDone(trailers), ErrInvalidTrailer)
+	assert.False(t, w.Done())
+
+	// Test: Announcing a field that may not be a trailer
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.ErrorIs(t, w.WriteHeaders(chunkedHeaders("X-Checksum, Content-Length")), ErrInvalidTrailer)
+
+	// Test: Ending a body that is not chunked
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	require.Error(t, w.WriteChunkedBodyDone(nil))
+
+	// Test: HTTP/1.0 client gets neither chunks nor trailers
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestVersion("1.0")
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(chunkedHeaders("X-Checksum")))
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	trailers = headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	require.NoError(t, w.WriteChunkedBodyDone(trailers))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello", stripDate(buf.String()))
+}
+
+func TestWriteHead(t *testing.T) {
+	// Test: Body of a response to HEAD is dropped
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	n, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Type: text/plain\r\n\r\n", stripDate(buf.String()))
+	assert.True(t, w.Done())
+
+	// Test: Copied body is not even read
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	source := strings.NewReader("hello")
+	// a reader without WriteTo, which io.Copy would call instead
+	copied, err := io.Copy(w, struct{ io.Reader }{source})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), copied)
+	assert.Equal(t, 5, source.Len())
+	assert.True(t, w.Done())
+
+	// Test: Buffered body still sets the Content-Length it would have had
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	body, err := NewBodyWriter(w, Status200, headers.NewHeaders())
+	require.NoError(t, err)
+	_, err = body.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n", stripDate(buf.String()))
+
+	// Test: Chunked body has neither chunks nor a last chunk
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	require.NoError(t, w.WriteStatusLine(Status200))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	assert.True(t, w.Done())
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.WriteChunkedBodyDone(nil))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n", stripDate(buf.String()))
+}
+
+func TestDateAndServer(t *testing.T) {
+	// Test: Date and Server are added to the final response
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetServer("test")
+	require.NoError(t, w.WriteStatusLine(Status200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	require.NoError(t, w.Flush())
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "test", resp.Header.Get("Server"))
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), date, 2*time.Second)
+
+	// Test: Handler overrides Date and suppresses Server
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetServer("test")
+	require.NoError(t, w.WriteStatusLine(Status200))
+	h := GetDefaultHeaders(0)
+	h.Set("Date", "Thu, 01 Jan 1970 00:00:00 GMT")
+	h.Set("Server", "")
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nContent-Type: text/plain\r\n"+
+		"Date: Thu, 01 Jan 1970 00:00:00 GMT\r\n\r\n", buf.String())
+
+	// Test: Interim response has no Date
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status100))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", buf.String())
+}
+
+func TestWriterHooks(t *testing.T) {
+	// Test: Hooks see and change the headers of the final response only
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var seen []StatusCode
+	w.OnHeaders(func(statusCode StatusCode, h *headers.Headers) {
+		seen = append(seen, statusCode)
+		h.Set("X-Hook", "yes")
+	})
+	require.NoError(t, w.WriteStatusLine(Status100))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.WriteStatusLine(Status201))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, []StatusCode{Status201}, seen)
+	assert.Equal(t, Status201, w.StatusCode())
+	assert.Equal(t, int64(5), w.BodyBytes())
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 5\r\n"+
+		"Content-Type: text/plain\r\nX-Hook: yes\r\n\r\nhello", stripDate(buf.String()))
+
+	// Test: Finish hooks run once
+	finished := 0
+	w.OnFinish(func() { finished++ })
+	w.Finish()
+	w.Finish()
+	assert.Equal(t, 1, finished)
+
+	// Test: Chunk framing is not counted as body
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(Status200))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte(" world"))
+	require.NoError(t, err)
+	require.NoError(t, w.WriteChunkedBodyDone(nil))
+	assert.Equal(t, int64(11), w.BodyBytes())
+}
+
+func TestHTTPDate(t *testing.T) {
+	now := time.Date(2024, time.March, 5, 7, 8, 9, 0, time.FixedZone("CET", 3600))
+	assert.Equal(t, "Tue, 05 Mar 2024 06:08:09 GMT", httpDate(now))
+	// Test: Later in the same second gets the cached value
+	assert.Equal(t, "Tue, 05 Mar 2024 06:08:09 GMT", httpDate(now.Add(500*time.Millisecond)))
+	assert.Equal(t, "Tue, 05 Mar 2024 06:08:10 GMT", httpDate(now.Add(time.Second)))
+}
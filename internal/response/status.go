@@ -0,0 +1,159 @@
+package response
+
+type StatusCode int
+
+// Status codes registered with IANA, see
+// https://www.iana.org/assignments/http-status-codes
+const (
+	Status100 StatusCode = 100 // Continue
+	Status101 StatusCode = 101 // Switching Protocols
+	Status102 StatusCode = 102 // Processing
+	Status103 StatusCode = 103 // Early Hints
+
+	Status200 StatusCode = 200 // OK
+	Status201 StatusCode = 201 // Created
+	Status202 StatusCode = 202 // Accepted
+	Status203 StatusCode = 203 // Non-Authoritative Information
+	Status204 StatusCode = 204 // No Content
+	Status205 StatusCode = 205 // Reset Content
+	Status206 StatusCode = 206 // Partial Content
+	Status207 StatusCode = 207 // Multi-Status
+	Status208 StatusCode = 208 // Already Reported
+	Status226 StatusCode = 226 // IM Used
+
+	Status300 StatusCode = 300 // Multiple Choices
+	Status301 StatusCode = 301 // Moved Permanently
+	Status302 StatusCode = 302 // Found
+	Status303 StatusCode = 303 // See Other
+	Status304 StatusCode = 304 // Not Modified
+	Status305 StatusCode = 305 // Use Proxy
+	Status307 StatusCode = 307 // Temporary Redirect
+	Status308 StatusCode = 308 // Permanent Redirect
+
+	Status400 StatusCode = 400 // Bad Request
+	Status401 StatusCode = 401 // Unauthorized
+	Status402 StatusCode = 402 // Payment Required
+	Status403 StatusCode = 403 // Forbidden
+	Status404 StatusCode = 404 // Not Found
+	Status405 StatusCode = 405 // Method Not Allowed
+	Status406 StatusCode = 406 // Not Acceptable
+	Status407 StatusCode = 407 // Proxy Authentication Required
+	Status408 StatusCode = 408 // Request Timeout
+	Status409 StatusCode = 409 // Conflict
+	Status410 StatusCode = 410 // Gone
+	Status411 StatusCode = 411 // Length Required
+	Status412 StatusCode = 412 // Precondition Failed
+	Status413 StatusCode = 413 // Content Too Large
+	Status414 StatusCode = 414 // URI Too Long
+	Status415 StatusCode = 415 // Unsupported Media Type
+	Status416 StatusCode = 416 // Range Not Satisfiable
+	Status417 StatusCode = 417 // Expectation Failed
+	Status421 StatusCode = 421 // Misdirected Request
+	Status422 StatusCode = 422 // Unprocessable Content
+	Status423 StatusCode = 423 // Locked
+	Status424 StatusCode = 424 // Failed Dependency
+	Status425 StatusCode = 425 // Too Early
+	Status426 StatusCode = 426 // Upgrade Required
+	Status428 StatusCode = 428 // Precondition Required
+	Status429 StatusCode = 429 // Too Many Requests
+	Status431 StatusCode = 431 // Request Header Fields Too Large
+	Status451 StatusCode = 451 // Unavailable For Legal Reasons
+
+	Status500 StatusCode = 500 // Internal Server Error
+	Status501 StatusCode = 501 // Not Implemented
+	Status502 StatusCode = 502 // Bad Gateway
+	Status503 StatusCode = 503 // Service Unavailable
+	Status504 StatusCode = 504 // Gateway Timeout
+	Status505 StatusCode = 505 // HTTP Version Not Supported
+	Status506 StatusCode = 506 // Variant Also Negotiates
+	Status507 StatusCode = 507 // Insufficient Storage
+	Status508 StatusCode = 508 // Loop Detected
+	Status510 StatusCode = 510 // Not Extended
+	Status511 StatusCode = 511 // Network Authentication Required
+)
+
+var statusText = map[StatusCode]string{
+	Status100: "Continue",
+	Status101: "Switching Protocols",
+	Status102: "Processing",
+	Status103: "Early Hints",
+
+	Status200: "OK",
+	Status201: "Created",
+	Status202: "Accepted",
+	Status203: "Non-Authoritative Information",
+	Status204: "No Content",
+	Status205: "Reset Content",
+	Status206: "Partial Content",
+	Status207: "Multi-Status",
+	Status208: "Already Reported",
+	Status226: "IM Used",
+
+	Status300: "Multiple Choices",
+	Status301: "Moved Permanently",
+	Status302: "Found",
+	Status303: "See Other",
+	Status304: "Not Modified",
+	Status305: "Use Proxy",
+	Status307: "Temporary Redirect",
+	Status308: "Permanent Redirect",
+
+	Status400: "Bad Request",
+	Status401: "Unauthorized",
+	Status402: "Payment Required",
+	Status403: "Forbidden",
+	Status404: "Not Found",
+	Status405: "Method Not Allowed",
+	Status406: "Not Acceptable",
+	Status407: "Proxy Authentication Required",
+	Status408: "Request Timeout",
+	Status409: "Conflict",
+	Status410: "Gone",
+	Status411: "Length Required",
+	Status412: "Precondition Failed",
+	Status413: "Content Too Large",
+	Status414: "URI Too Long",
+	Status415: "Unsupported Media Type",
+	Status416: "Range Not Satisfiable",
+	Status417: "Expectation Failed",
+	Status421: "Misdirected Request",
+	Status422: "Unprocessable Content",
+	Status423: "Locked",
+	Status424: "Failed Dependency",
+	Status425: "Too Early",
+	Status426: "Upgrade Required",
+	Status428: "Precondition Required",
+	Status429: "Too Many Requests",
+	Status431: "Request Header Fields Too Large",
+	Status451: "Unavailable For Legal Reasons",
+
+	Status500: "Internal Server Error",
+	Status501: "Not Implemented",
+	Status502: "Bad Gateway",
+	Status503: "Service Unavailable",
+	Status504: "Gateway Timeout",
+	Status505: "HTTP Version Not Supported",
+	Status506: "Variant Also Negotiates",
+	Status507: "Insufficient Storage",
+	Status508: "Loop Detected",
+	Status510: "Not Extended",
+	Status511: "Network Authentication Required",
+}
+
+// StatusText returns the reason phrase for statusCode, or the empty string
+// for a code it does not know.
+func StatusText(statusCode StatusCode) string {
+	return statusText[statusCode]
+}
+
+// informational reports whether statusCode is a 1xx interim response, which
+// is followed by another response to the same request.
+func informational(statusCode StatusCode) bool {
+	return statusCode >= 100 && statusCode < 200
+}
+
+// bodyAllowed reports whether a response with statusCode may have a body,
+// which 1xx, 204 and 304 responses never do.
+func bodyAllowed(statusCode StatusCode) bool {
+	return !informational(statusCode) && statusCode != Status204 && statusCode != Status304
+}
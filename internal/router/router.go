@@ -0,0 +1,243 @@
+package router
+
+import (
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Router dispatches requests to handlers by method and path pattern. Patterns
+// are made of "/" separated segments, each one of
+//   - a literal, matching only itself
+//   - {name}, matching any single non-empty segment
+//   - *name, last in the pattern, matching the rest of the path
+//
+// Captured segments are stored in Request.PathParams under their name. When
+// several patterns match a path, the one with the most literal segments
+// first wins, so /users/me takes precedence over /users/{id}.
+type Router struct {
+	routes []*route
+}
+
+type segmentKind int
+
+// ordered by precedence, a lower kind wins over a higher one
+const (
+	segmentLiteral segmentKind = iota
+	segmentParam
+	segmentCatchAll
+)
+
+type segment struct {
+	kind  segmentKind
+	value string
+}
+
+type route struct {
+	pattern  string
+	segments []segment
+	handlers map[string]server.Handler
+}
+
+func New() *Router {
+	return &Router{}
+}
+
+// Handle registers handler for requests with method and a path matching
+// pattern. It panics on a malformed pattern or a method and pattern pair that
+// is already registered. GET handlers also answer HEAD requests unless a HEAD
+// handler is registered for the same pattern.
+func (r *Router) Handle(method, pattern string, handler server.Handler) {
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		panic(fmt.Sprintf("router: %v", err))
+	}
+	rt := r.findRoute(pattern)
+	if rt == nil {
+		rt = &route{pattern: pattern, segments: segments, handlers: make(map[string]server.Handler)}
+		r.routes = append(r.routes, rt)
+	}
+	if _, exists := rt.handlers[method]; exists {
+		panic(fmt.Sprintf("router: %s %s registered twice", method, pattern))
+	}
+	rt.handlers[method] = handler
+}
+
+func (r *Router) findRoute(pattern string) *route {
+	for _, rt := range r.routes {
+		if rt.pattern == pattern {
+			return rt
+		}
+	}
+	return nil
+}
+
+// Serve is a server.Handler. Requests whose path matches no pattern are
+// answered with 404, and those whose path matches but method does not with
+// 405 and an Allow header listing the methods that would.
+func (r *Router) Serve(w *response.Writer, req *request.Request) error {
+	target := req.RequestLine.Target
+	var rt *route
+	var params map[string]string
+	if target.Form == request.TargetOrigin || target.Form == request.TargetAbsolute {
+		rt, params = r.match(target.RawPath)
+	}
+	if rt == nil {
+		writeStatus(w, response.Status404, nil)
+		return nil
+	}
+	handler, ok := rt.handlers[req.RequestLine.Method]
+	if !ok && req.RequestLine.Method == "HEAD" {
+		handler, ok = rt.handlers["GET"]
+	}
+	if !ok {
+		writeStatus(w, response.Status405, rt.allowed())
+		return nil
+	}
+	req.PathParams = params
+	return handler(w, req)
+}
+
+// match returns the route that best matches the percent-encoded path along
+// with its decoded captured parameters, or nil if none does. Splitting the
+// path before decoding it keeps an encoded "/" within its segment.
+func (r *Router) match(rawPath string) (*route, map[string]string) {
+	parts := strings.Split(strings.TrimPrefix(rawPath, "/"), "/")
+	var best *route
+	var bestParams map[string]string
+	for _, rt := range r.routes {
+		params, ok := rt.match(parts)
+		if ok && (best == nil || rt.precedes(best)) {
+			best, bestParams = rt, params
+		}
+	}
+	return best, bestParams
+}
+
+func (rt *route) match(parts []string) (map[string]string, bool) {
+	params := make(map[string]string)
+	for i, segment := range rt.segments {
+		if segment.kind == segmentCatchAll {
+			params[segment.value] = unescape(strings.Join(parts[i:], "/"))
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		switch segment.kind {
+		case segmentLiteral:
+			if unescape(parts[i]) != segment.value {
+				return nil, false
+			}
+		case segmentParam:
+			if parts[i] == "" {
+				return nil, false
+			}
+			params[segment.value] = unescape(parts[i])
+		}
+	}
+	if len(parts) != len(rt.segments) {
+		return nil, false
+	}
+	return params, true
+}
+
+// unescape decodes a part of a path the request parser has already checked
+// to be validly percent-encoded.
+func unescape(part string) string {
+	unescaped, err := url.PathUnescape(part)
+	if err != nil {
+		return part
+	}
+	return unescaped
+}
+
+// precedes reports whether rt takes precedence over other when both match.
+func (rt *route) precedes(other *route) bool {
+	for i := range min(len(rt.segments), len(other.segments)) {
+		if rt.segments[i].kind != other.segments[i].kind {
+			return rt.segments[i].kind < other.segments[i].kind
+		}
+	}
+	return len(rt.segments) > len(other.segments)
+}
+
+// Methods lists the methods r has handlers for on any route, along with HEAD
+// where GET is handled and the OPTIONS the server itself answers. It suits
+// server.Config.Methods.
+func (r *Router) Methods() []string {
+	methods := []string{"OPTIONS"}
+	for _, rt := range r.routes {
+		for _, method := range rt.allowed() {
+			if !slices.Contains(methods, method) {
+				methods = append(methods, method)
+			}
+		}
+	}
+	slices.Sort(methods)
+	return methods
+}
+
+// allowed lists the methods rt has handlers for, for the Allow header.
+func (rt *route) allowed() []string {
+	methods := make([]string, 0, len(rt.handlers)+1)
+	for method := range rt.handlers {
+		methods = append(methods, method)
+	}
+	if _, ok := rt.handlers["GET"]; ok && !slices.Contains(methods, "HEAD") {
+		methods = append(methods, "HEAD")
+	}
+	slices.Sort(methods)
+	return methods
+}
+
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("pattern %q does not start with /", pattern)
+	}
+	parts := strings.Split(pattern[1:], "/")
+	segments := make([]segment, 0, len(parts))
+	names := make(map[string]bool)
+	for i, part := range parts {
+		var seg segment
+		switch {
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			seg = segment{kind: segmentParam, value: part[1 : len(part)-1]}
+		case strings.HasPrefix(part, "*"):
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("pattern %q has %s before its last segment", pattern, part)
+			}
+			seg = segment{kind: segmentCatchAll, value: part[1:]}
+		default:
+			if strings.ContainsAny(part, "{}*") {
+				return nil, fmt.Errorf("pattern %q has a malformed segment %q", pattern, part)
+			}
+			segments = append(segments, segment{kind: segmentLiteral, value: part})
+			continue
+		}
+		if seg.value == "" {
+			return nil, fmt.Errorf("pattern %q has an unnamed parameter", pattern)
+		}
+		if names[seg.value] {
+			return nil, fmt.Errorf("pattern %q has parameter %s twice", pattern, seg.value)
+		}
+		names[seg.value] = true
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+func writeStatus(w *response.Writer, statusCode response.StatusCode, allow []string) {
+	w.WriteStatusLine(statusCode)
+	body := fmt.Appendf(nil, "%d %s\n", statusCode, response.StatusText(statusCode))
+	headers := response.GetDefaultHeaders(len(body))
+	if allow != nil {
+		headers.Set("Allow", strings.Join(allow, ", "))
+	}
+	w.WriteHeaders(headers)
+	w.WriteBody(body)
+}
@@ -0,0 +1,119 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs a request through router and returns the parsed response
+func serve(t *testing.T, router *Router, method, target string) *http.Response {
+	req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	var out bytes.Buffer
+	w := response.NewWriter(&out)
+	router.Serve(w, req)
+	require.NoError(t, w.Flush())
+	resp, err := http.ReadResponse(bufio.NewReader(&out), nil)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestRouterMatch(t *testing.T) {
+	var matched string
+	var params map[string]string
+	router := New()
+	handle := func(method, pattern string) {
+		router.Handle(method, pattern, func(w *response.Writer, req *request.Request) error {
+			matched = method + " " + pattern
+			params = req.PathParams
+			w.WriteStatusLine(response.Status200)
+			return w.WriteHeaders(response.GetDefaultHeaders(0))
+		})
+	}
+	handle("GET", "/")
+	handle("GET", "/users/{id}")
+	handle("DELETE", "/users/{id}")
+	handle("GET", "/users/me")
+	handle("GET", "/users/{id}/posts/{post}")
+	handle("GET", "/static/*rest")
+
+	tests := []struct {
+		method  string
+		target  string
+		matched string
+		params  map[string]string
+	}{
+		{"GET", "/", "GET /", map[string]string{}},
+		{"GET", "/users/42", "GET /users/{id}", map[string]string{"id": "42"}},
+		{"DELETE", "/users/42", "DELETE /users/{id}", map[string]string{"id": "42"}},
+		{"GET", "/users/me", "GET /users/me", map[string]string{}},
+		{"GET", "/users/42/posts/7?sort=asc", "GET /users/{id}/posts/{post}", map[string]string{"id": "42", "post": "7"}},
+		{"GET", "/static/css/site.css", "GET /static/*rest", map[string]string{"rest": "css/site.css"}},
+		{"GET", "/static/", "GET /static/*rest", map[string]string{"rest": ""}},
+		{"GET", "/users/a%2Fb", "GET /users/{id}", map[string]string{"id": "a/b"}},
+		{"GET", "/%75sers/42", "GET /users/{id}", map[string]string{"id": "42"}},
+		{"GET", "http://localhost/users/42", "GET /users/{id}", map[string]string{"id": "42"}},
+		{"HEAD", "/users/42", "GET /users/{id}", map[string]string{"id": "42"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			matched, params = "", nil
+			resp := serve(t, router, tt.method, tt.target)
+			assert.Equal(t, 200, resp.StatusCode)
+			assert.Equal(t, tt.matched, matched)
+			assert.Equal(t, tt.params, params)
+		})
+	}
+}
+
+func TestRouterNotFound(t *testing.T) {
+	router := New()
+	router.Handle("GET", "/users/{id}", func(w *response.Writer, req *request.Request) error { return nil })
+	router.Handle("PUT", "/users/{id}", func(w *response.Writer, req *request.Request) error { return nil })
+
+	// Test: Unknown path
+	resp := serve(t, router, "GET", "/posts/1")
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// Test: Parameters do not match empty segments
+	resp = serve(t, router, "GET", "/users/")
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// Test: Server-wide OPTIONS target
+	resp = serve(t, router, "OPTIONS", "*")
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// Test: Known path, other method
+	resp = serve(t, router, "POST", "/users/1")
+	assert.Equal(t, 405, resp.StatusCode)
+	assert.Equal(t, "GET, HEAD, PUT", resp.Header.Get("Allow"))
+}
+
+func TestRouterInvalidPatterns(t *testing.T) {
+	router := New()
+	router.Handle("GET", "/a/{id}", func(w *response.Writer, req *request.Request) error { return nil })
+	assert.Panics(t, func() { router.Handle("GET", "/a/{id}", nil) })
+	assert.Panics(t, func() { router.Handle("GET", "no-slash", nil) })
+	assert.Panics(t, func() { router.Handle("GET", "/*rest/more", nil) })
+	assert.Panics(t, func() { router.Handle("GET", "/{}", nil) })
+	assert.Panics(t, func() { router.Handle("GET", "/{id}/{id}", nil) })
+	assert.Panics(t, func() { router.Handle("GET", "/a{id}", nil) })
+}
+
+func TestRouterMethods(t *testing.T) {
+	router := New()
+	noop := func(w *response.Writer, req *request.Request) error { return nil }
+	router.Handle("GET", "/", noop)
+	router.Handle("POST", "/users", noop)
+	router.Handle("GET", "/users/{id}", noop)
+	router.Handle("DELETE", "/users/{id}", noop)
+	assert.Equal(t, []string{"DELETE", "GET", "HEAD", "OPTIONS", "POST"}, router.Methods())
+}
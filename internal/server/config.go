@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Config holds the settings of a Server. The zero value is usable.
+type Config struct {
+	// Addr is the TCP address ListenAndServe binds to, such as
+	// "127.0.0.1:42069". An empty Addr means ":http".
+	Addr string
+	// Listener, if set, is served by ListenAndServe instead of binding Addr.
+	Listener net.Listener
+	// Limits bounds the size of requests. Requests over them are answered
+	// with 414, 431 or 413.
+	Limits request.Limits
+	// Timeouts bounds how long a connection may take to send requests and
+	// receive responses.
+	Timeouts Timeouts
+	// Logger receives the errors the server cannot report to a client.
+	// Defaults to slog.Default().
+	Logger *slog.Logger
+	// ErrorHandler writes the response to a request the server rejects before
+	// it reaches the handler, or that the handler failed. WriteErrorText,
+	// WriteErrorHTML and WriteErrorJSON are ready made. Defaults to
+	// WriteErrorText.
+	ErrorHandler ErrorHandler
+	// ServerName is sent in the Server header of every response, unless the
+	// handler sets its own. An empty ServerName sends none.
+	ServerName string
+	// Methods lists the request methods the handler supports, which the
+	// server announces in its answer to OPTIONS *. Defaults to GET, HEAD and
+	// OPTIONS.
+	Methods []string
+}
+
+// ErrorHandler writes a complete response with statusCode for err.
+type ErrorHandler func(w *response.Writer, statusCode response.StatusCode, err error)
+
+func (c Config) withDefaults() Config {
+	if c.Addr == "" {
+		c.Addr = ":http"
+	}
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+	if c.ErrorHandler == nil {
+		c.ErrorHandler = WriteErrorText
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = []string{"GET", "HEAD", "OPTIONS"}
+	}
+	return c
+}
+
+// WriteErrorText writes err as a plain text response.
+func WriteErrorText(w *response.Writer, statusCode response.StatusCode, err error) {
+	w.WriteStatusLine(statusCode)
+	body := fmt.Appendf(nil, "%v\n", err)
+	headers := response.GetDefaultHeaders(len(body))
+	w.WriteHeaders(headers)
+	w.WriteBody(body)
+}
+
+const errorHTML = `<html>
+  <head>
+    <title>%d %s</title>
+  </head>
+  <body>
+    <h1>%s</h1>
+    <p>%s</p>
+  </body>
+</html>
+`
+
+// WriteErrorHTML writes err as an HTML page.
+func WriteErrorHTML(w *response.Writer, statusCode response.StatusCode, err error) {
+	w.WriteStatusLine(statusCode)
+	statusText := html.EscapeString(response.StatusText(statusCode))
+	body := fmt.Appendf(nil, errorHTML, statusCode, statusText, statusText, html.EscapeString(err.Error()))
+	headers := response.GetDefaultHeaders(len(body))
+	headers.Set("Content-Type", "text/html")
+	w.WriteHeaders(headers)
+	w.WriteBody(body)
+}
+
+// WriteErrorJSON writes err as a JSON object of the form
+// {"status": 404, "error": "Not Found", "message": "no such user"}.
+func WriteErrorJSON(w *response.Writer, statusCode response.StatusCode, err error) {
+	w.WriteStatusLine(statusCode)
+	body, _ := json.Marshal(struct {
+		Status  int    `json:"status"`
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}{int(statusCode), response.StatusText(statusCode), err.Error()})
+	body = append(body, '\n')
+	headers := response.GetDefaultHeaders(len(body))
+	headers.Set("Content-Type", "application/json")
+	w.WriteHeaders(headers)
+	w.WriteBody(body)
+}
+
+// Timeouts are applied as deadlines on the connection. A zero field means no
+// timeout.
+type Timeouts struct {
+	// ReadHeader bounds reading a request line and headers, counted from
+	// the first byte of the request. A request that does not make it in time
+	// is answered with 408.
+	ReadHeader time.Duration
+	// Read bounds reading the body, counted from the end of the headers.
+	Read time.Duration
+	// Write bounds writing the response, counted from the end of the
+	// headers.
+	Write time.Duration
+	// Idle bounds the wait for the next request on a kept-alive connection.
+	// The wait for the first request is bounded by ReadHeader instead.
+	Idle time.Duration
+}
+
+// deadline returns when a timeout starting now runs out, or the zero time
+// that clears a deadline for a zero timeout.
+func deadline(timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
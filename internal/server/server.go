@@ -1,68 +1,433 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"httpfromtcp/internal/headers"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"io"
 	"net"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type Server struct {
-	listener net.Listener
-	handler  Handler
-	closed   atomic.Bool
+	handler Handler
+	config  Config
+	closed  atomic.Bool
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]connState
 }
 
+// connState tells connections waiting for a request, which Shutdown may close
+// right away, from those in the middle of one.
+type connState int
+
+const (
+	connIdle connState = iota
+	connActive
+)
+
+// shutdownPollInterval is how often Shutdown checks whether the active
+// connections have finished.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// HandlerError is returned by a handler to have the request answered with
+// StatusCode and Message.
 type HandlerError struct {
 	StatusCode response.StatusCode
 	Message    string
 }
 
-type Handler func(w *response.Writer, req *request.Request)
+func (e *HandlerError) Error() string {
+	return e.Message
+}
+
+// Handler answers req through w. An error it returns before writing any of
+// the response is answered by the server: a *HandlerError with its status
+// code and message, any other error with 500. Once the response has started
+// it is too late for that, and the connection is closed instead.
+type Handler func(w *response.Writer, req *request.Request) error
 
-func Serve(port int, handler Handler) (*Server, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		return nil, err
+// Middleware wraps a Handler in another one, to act on requests before they
+// reach it and on what it answers.
+type Middleware func(next Handler) Handler
+
+// Chain wraps handler in middlewares, the first of them being the outermost,
+// so it sees requests first and has the last word on their responses.
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
 	}
-	server := &Server{listener: listener, handler: handler}
-	go server.listen()
-	return server, nil
+	return handler
 }
 
-func (s *Server) Close() error {
-	s.closed.Store(true)
-	if s.listener != nil {
-		return s.listener.Close()
+// panicError is a panic recovered from a handler, along with the stack it
+// was raised from.
+type panicError struct {
+	value any
+	stack []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v\n%s", e.value, e.stack)
+}
+
+// ErrServerClosed is returned by Serve and ListenAndServe once Close or
+// Shutdown has been called.
+var ErrServerClosed = errors.New("server closed")
+
+// New returns a Server that answers requests with handler. It does not accept
+// connections until ListenAndServe or Serve is called.
+func New(handler Handler, config Config) *Server {
+	return &Server{
+		handler:   handler,
+		config:    config.withDefaults(),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]connState),
+	}
+}
+
+// ListenAndServe serves connections from Config.Listener, or from a new TCP
+// listener bound to Config.Addr if there is none. It blocks until the server
+// is closed and then returns ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	listener := s.config.Listener
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", s.config.Addr)
+		if err != nil {
+			return err
+		}
 	}
-	return nil
+	return s.Serve(listener)
 }
 
-func (s *Server) listen() {
+// Serve accepts connections from listener and answers their requests, each
+// connection in its own goroutine. It blocks until the server is closed and
+// then returns ErrServerClosed. The listener is closed along with the server.
+func (s *Server) Serve(listener net.Listener) error {
+	if !s.trackListener(listener) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer s.forgetListener(listener)
+	var backoff time.Duration
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			if s.closed.Load() {
-				return
+				return ErrServerClosed
 			}
-			fmt.Println("accepting conn failed:", err.Error())
+			// keep going through errors like running out of file
+			// descriptors, backing off so as not to spin on them
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			s.config.Logger.Warn("accepting conn failed", "retry_in", backoff, "error", err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		if !s.trackConn(conn, connIdle) {
+			conn.Close()
 			continue
 		}
 		go s.handle(conn)
 	}
 }
 
+// Close stops accepting connections and closes all open ones immediately,
+// cutting off any request in progress. Use Shutdown to let them finish.
+func (s *Server) Close() error {
+	err := s.closeListeners()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// Shutdown stops accepting connections and waits for the requests in flight
+// to be answered. Idle connections are closed right away, and active ones as
+// soon as their current response is written. If ctx expires first, the
+// remaining connections are closed and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.closeListeners()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeListeners marks the server closed and closes the listeners it serves,
+// returning the first error closing them.
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed.Store(true)
+	var err error
+	for listener := range s.listeners {
+		if closeErr := listener.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(s.listeners, listener)
+	}
+	return err
+}
+
+func (s *Server) trackListener(listener net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed.Load() {
+		return false
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
+
+func (s *Server) forgetListener(listener net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, listener)
+}
+
+// closeIdleConns closes the connections waiting for a request and reports
+// whether no connections are left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.conns {
+		if state == connIdle {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+// trackConn records the state of conn, reporting false if the server is
+// closing and conn should not take on a new request, or if conn is no longer
+// tracked because Shutdown closed it as idle.
+func (s *Server) trackConn(conn net.Conn, state connState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed.Load() && state == connIdle {
+		return false
+	}
+	if _, tracked := s.conns[conn]; !tracked && state == connActive {
+		return false
+	}
+	s.conns[conn] = state
+	return true
+}
+
+func (s *Server) forgetConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
 func (s *Server) handle(conn net.Conn) {
+	defer s.forgetConn(conn)
 	defer conn.Close()
-  writer := response.NewWriter(conn)
-	request, err := request.RequestFromReader(conn)
-	if err != nil {
-    writer.WriteStatusLine(response.Status400)
-    body := fmt.Appendf(nil, "error parsing request: %v\n", err)
-    headers := response.GetDefaultHeaders(len(body))
-    writer.WriteHeaders(headers)
-    writer.WriteBody(body)
-	}
-	s.handler(writer, request)
+	// handler panics are answered with 500, this catches any other one so it
+	// only costs this connection
+	defer func() {
+		if p := recover(); p != nil {
+			s.config.Logger.Error("panic serving connection", "remote_addr", conn.RemoteAddr().String(),
+				"panic", p, "stack", string(debug.Stack()))
+		}
+	}()
+	timeouts := s.config.Timeouts
+	reader := request.NewReaderWithLimits(conn, s.config.Limits)
+	for first := true; ; first = false {
+		// a client that never starts another request is simply hung up on
+		if first {
+			conn.SetReadDeadline(deadline(timeouts.ReadHeader))
+		} else {
+			conn.SetReadDeadline(deadline(timeouts.Idle))
+		}
+		if !s.trackConn(conn, connIdle) {
+			return
+		}
+		if err := reader.Wait(); err != nil {
+			return
+		}
+		// Shutdown may have closed the connection as idle meanwhile, and
+		// already returned, so the request it was closed on is dropped
+		// unanswered even if some of it was read
+		if !s.trackConn(conn, connActive) {
+			return
+		}
+		writer := response.NewWriter(conn)
+		writer.SetServer(s.config.ServerName)
+		conn.SetReadDeadline(deadline(timeouts.ReadHeader))
+		request, err := reader.ReadRequest()
+		if errors.Is(err, io.EOF) || clientGone(err) {
+			return
+		}
+		if err != nil {
+			conn.SetWriteDeadline(deadline(timeouts.Write))
+			s.readFailed(conn, writer, err)
+			return
+		}
+		conn.SetReadDeadline(deadline(timeouts.Read))
+		conn.SetWriteDeadline(deadline(timeouts.Write))
+		writer.SetRequestVersion(request.RequestLine.HttpVersion)
+		writer.SetRequestMethod(request.RequestLine.Method)
+		request.RemoteAddr = conn.RemoteAddr().String()
+		if !request.KeepAlive() || s.closed.Load() {
+			writer.SetClose()
+		}
+		keepAlive := s.serveRequest(conn, writer, request)
+		writer.Finish()
+		if !keepAlive {
+			return
+		}
+		// skip what the handler left unread of the body to get to the next
+		// request, a body that fails to read leaves no next request to find
+		if err := request.DiscardBody(); err != nil {
+			return
+		}
+	}
+}
+
+// serveRequest answers request, through the handler or with an error response
+// of the server's own, and reports whether the connection can carry on with
+// the next request.
+func (s *Server) serveRequest(conn net.Conn, writer *response.Writer, request *request.Request) bool {
+	if isServerOptions(request) {
+		s.writeOptions(writer)
+	} else if err := s.callHandler(writer, request); err != nil && !isBodyError(request, err) {
+		s.handlerFailed(conn, writer, err)
+	}
+	if err := writer.Flush(); err != nil {
+		return false
+	}
+	// a handler that left the response unfinished leaves the client no way
+	// to find where the next response starts, so hang up on it
+	if writer.Closing() || !writer.Done() {
+		// answer for a handler that gave up on a body it could not read
+		if bodyErr := request.BodyError(); bodyErr != nil && !clientGone(bodyErr) && !writer.Started() {
+			s.readFailed(conn, writer, bodyErr)
+		}
+		return false
+	}
+	return true
+}
+
+// callHandler runs the handler, recovering a panic into a *panicError.
+func (s *Server) callHandler(w *response.Writer, req *request.Request) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = &panicError{value: p, stack: debug.Stack()}
+		}
+	}()
+	return s.handler(w, req)
+}
+
+// isBodyError reports whether err is the error reading the body of req
+// failed with, which is answered like a malformed request.
+func isBodyError(req *request.Request, err error) bool {
+	bodyErr := req.BodyError()
+	return bodyErr != nil && errors.Is(err, bodyErr)
+}
+
+// handlerFailed answers the request the handler returned err for. Errors
+// other than a *HandlerError are logged instead of being shown to the client.
+func (s *Server) handlerFailed(conn net.Conn, w *response.Writer, err error) {
+	var handlerErr *HandlerError
+	if !errors.As(err, &handlerErr) {
+		s.config.Logger.Error("handler failed", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		handlerErr = &HandlerError{StatusCode: response.Status500, Message: response.StatusText(response.Status500)}
+	}
+	// the state a panicking handler left the request in is anyone's guess
+	var panicErr *panicError
+	if errors.As(err, &panicErr) {
+		w.SetClose()
+	}
+	if w.Started() {
+		w.SetClose()
+		return
+	}
+	s.config.ErrorHandler(w, handlerErr.StatusCode, handlerErr)
+}
+
+// isServerOptions reports whether req is an OPTIONS *, which asks about the
+// server as a whole rather than any resource a handler serves.
+func isServerOptions(req *request.Request) bool {
+	return req.RequestLine.Method == "OPTIONS" && req.RequestLine.Target.Form == request.TargetAsterisk
+}
+
+// writeOptions answers OPTIONS * with the methods the server supports.
+func (s *Server) writeOptions(w *response.Writer) {
+	w.WriteStatusLine(response.Status200)
+	h := headers.NewHeaders()
+	h.Set("Allow", strings.Join(s.config.Methods, ", "))
+	h.Set("Content-Length", "0")
+	w.WriteHeaders(h)
+}
+
+// clientGone reports whether err means the client closed or reset the
+// connection, leaving nobody to read an error response.
+func clientGone(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// errRequestTimeout is shown to the client in place of a read error that hit
+// a deadline, whose message names the server's address.
+var errRequestTimeout = errors.New("request timed out")
+
+// readFailed answers a request that could not be read because of err and
+// closes the connection after it. Errors of the connection rather than of the
+// request are logged, and the client only told their status.
+func (s *Server) readFailed(conn net.Conn, w *response.Writer, err error) {
+	statusCode := errorStatusCode(err)
+	var requestErr *request.Error
+	var headersErr *headers.Error
+	if errors.Is(err, os.ErrDeadlineExceeded) || !errors.As(err, &requestErr) && !errors.As(err, &headersErr) {
+		s.config.Logger.Warn("reading request failed", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		err = errRequestTimeout
+		if statusCode != response.Status408 {
+			err = errors.New(response.StatusText(statusCode))
+		}
+	}
+	w.SetClose()
+	s.config.ErrorHandler(w, statusCode, err)
+	w.Flush()
+}
+
+// errorStatusCode maps a request parsing error to the status code to answer
+// the request with. Errors that do not carry one are the client's fault.
+func errorStatusCode(err error) response.StatusCode {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return response.Status408
+	}
+	var requestErr *request.Error
+	if errors.As(err, &requestErr) {
+		return response.StatusCode(requestErr.StatusCode)
+	}
+	var headersErr *headers.Error
+	if errors.As(err, &headersErr) {
+		return response.StatusCode(headersErr.StatusCode)
+	}
+	return response.Status400
 }
@@ -0,0 +1,537 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer serves handler on an ephemeral port of the loopback interface
+// and returns the address to dial
+func startServer(t *testing.T, handler Handler, config Config) (*Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := New(handler, config)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return server, listener.Addr().String()
+}
+
+func echoHandler(w *response.Writer, req *request.Request) error {
+	body, err := req.ReadBody()
+	if err != nil {
+		return err
+	}
+	w.WriteStatusLine(response.Status200)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	_, err = w.WriteBody(body)
+	return err
+}
+
+func readResponse(t *testing.T, reader *bufio.Reader) (*http.Response, string) {
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestServeKeepAlive(t *testing.T) {
+	_, addr := startServer(t, echoHandler, Config{})
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: Pipelined requests are answered in order on one connection
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nfirst" +
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nsecond\r\n0\r\n\r\n" +
+		"POST / HTTP/1.1\r\nContent-Length: 5\r\nConnection: close\r\n\r\nthird"))
+	require.NoError(t, err)
+	resp, body := readResponse(t, reader)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "first", body)
+	assert.False(t, resp.Close)
+	_, body = readResponse(t, reader)
+	assert.Equal(t, "second", body)
+	resp, body = readResponse(t, reader)
+	assert.Equal(t, "third", body)
+	assert.True(t, resp.Close)
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServeHTTP10(t *testing.T) {
+	_, addr := startServer(t, func(w *response.Writer, req *request.Request) error {
+		if req.RequestLine.Target.Path == "/cont" {
+			w.WriteStatusLine(response.Status100)
+			w.WriteHeaders(headers.NewHeaders())
+			return echoHandler(w, req)
+		}
+		if req.RequestLine.Target.Path == "/chunked" {
+			w.WriteStatusLine(response.Status200)
+			h := response.GetDefaultHeaders(0)
+			h.Del("Content-Length")
+			h.Set("Transfer-Encoding", "chunked")
+			w.WriteHeaders(h)
+			w.WriteChunkedBody([]byte("hello "))
+			w.WriteChunkedBody([]byte("world"))
+			return w.WriteChunkedBodyDone(nil)
+		}
+		return echoHandler(w, req)
+	}, Config{})
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: HTTP/1.0 keep-alive is acknowledged
+	_, err = conn.Write([]byte("POST / HTTP/1.0\r\nConnection: keep-alive\r\nContent-Length: 2\r\n\r\nhi"))
+	require.NoError(t, err)
+	resp, body := readResponse(t, reader)
+	assert.Equal(t, "HTTP/1.1", resp.Proto)
+	assert.Equal(t, "keep-alive", resp.Header.Get("Connection"))
+	assert.Equal(t, "hi", body)
+
+	// Test: Interim response is not sent, nor does it close the connection
+	_, err = conn.Write([]byte("POST /cont HTTP/1.0\r\nConnection: keep-alive\r\nContent-Length: 2\r\n\r\nhi"))
+	require.NoError(t, err)
+	resp, body = readResponse(t, reader)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "keep-alive", resp.Header.Get("Connection"))
+	assert.Equal(t, "hi", body)
+
+	// Test: Chunked body is sent delimited by close instead
+	_, err = conn.Write([]byte("GET /chunked HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+	require.NoError(t, err)
+	resp, body = readResponse(t, reader)
+	assert.Empty(t, resp.TransferEncoding)
+	assert.True(t, resp.Close)
+	assert.Equal(t, "hello world", body)
+}
+
+func TestServeErrors(t *testing.T) {
+	_, addr := startServer(t, echoHandler, Config{
+		Limits: request.Limits{MaxHeaderCount: 1, MaxBodyBytes: 4},
+	})
+	tests := []struct {
+		name       string
+		data       string
+		statusCode int
+	}{
+		{"malformed request line", "GET /\r\n\r\n", 400},
+		{"unsupported version", "GET / HTTP/3.0\r\n\r\n", 505},
+		{"too many headers", "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\n\r\n", 431},
+		{"content-length too large", "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello", 413},
+		{"chunked body too large", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", 413},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte(tt.data))
+			require.NoError(t, err)
+			resp, _ := readResponse(t, bufio.NewReader(conn))
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			assert.True(t, resp.Close)
+		})
+	}
+}
+
+func TestServeClientGone(t *testing.T) {
+	handled := make(chan string, 1)
+	_, addr := startServer(t, func(w *response.Writer, req *request.Request) error {
+		handled <- req.RequestLine.RequestTarget
+		return echoHandler(w, req)
+	}, Config{})
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"head cut off", "GET / HTTP/1.1\r\nHost: loc"},
+		{"body cut off", "POST /body HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Test: Nothing is written back to a client that went away
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte(tt.data))
+			require.NoError(t, err)
+			require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+			got, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			assert.Empty(t, string(got))
+		})
+	}
+	assert.Equal(t, "/body", <-handled)
+
+	// Test: Request complete when the client half-closes is answered
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /done HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	resp, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "/done", <-handled)
+}
+
+func TestServeTimeouts(t *testing.T) {
+	var logs lockedBuffer
+	_, addr := startServer(t, echoHandler, Config{
+		Timeouts: Timeouts{ReadHeader: 100 * time.Millisecond},
+		Logger:   slog.New(slog.NewTextHandler(&logs, nil)),
+	})
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: Request that stalls in its headers gets 408
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: x"))
+	require.NoError(t, err)
+	resp, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 408, resp.StatusCode)
+
+	// Test: The client is not shown the read error, which names the server's
+	// address, but it is logged
+	assert.Equal(t, "request timed out\n", body)
+	assert.Contains(t, logs.String(), "i/o timeout")
+}
+
+func TestServeBodyTimeout(t *testing.T) {
+	var logs lockedBuffer
+	_, addr := startServer(t, echoHandler, Config{
+		Timeouts: Timeouts{Read: 100 * time.Millisecond},
+		Logger:   slog.New(slog.NewTextHandler(&logs, nil)),
+	})
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: Body that stalls gets 408 once the handler gives up reading it
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc"))
+	require.NoError(t, err)
+	resp, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 408, resp.StatusCode)
+	assert.True(t, resp.Close)
+	assert.Equal(t, "request timed out\n", body)
+	assert.Contains(t, logs.String(), "i/o timeout")
+}
+
+func TestServeIdleTimeout(t *testing.T) {
+	_, addr := startServer(t, echoHandler, Config{
+		Timeouts: Timeouts{Idle: 100 * time.Millisecond},
+	})
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	resp, _ := readResponse(t, reader)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.False(t, resp.Close)
+
+	// Test: Kept-alive connection with no next request is closed, unanswered
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	server, addr := startServer(t, func(w *response.Writer, req *request.Request) error {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		return echoHandler(w, req)
+	}, Config{})
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\nok"))
+	require.NoError(t, err)
+	<-started
+
+	// Test: Request in flight is answered before Shutdown returns
+	require.NoError(t, server.Shutdown(context.Background()))
+	resp, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "ok", body)
+
+	// Test: No new connections once shut down
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+}
+
+func TestShutdownIdle(t *testing.T) {
+	server, addr := startServer(t, echoHandler, Config{})
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	resp, _ := readResponse(t, reader)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.False(t, resp.Close)
+
+	// Test: Kept-alive connection waiting for a request is closed right away
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, server.Shutdown(ctx))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	server, addr := startServer(t, func(w *response.Writer, req *request.Request) error {
+		close(started)
+		<-release
+		return echoHandler(w, req)
+	}, Config{})
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+
+	// Test: Connections still active when ctx expires are closed
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServeShortBody(t *testing.T) {
+	_, addr := startServer(t, func(w *response.Writer, req *request.Request) error {
+		w.WriteStatusLine(response.Status200)
+		w.WriteHeaders(response.GetDefaultHeaders(10))
+		_, err := w.Write([]byte("abc"))
+		return err
+	}, Config{})
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: A body shorter than its Content-Length closes the connection
+	// rather than have the next response read as the rest of it
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, 1, bytes.Count(data, []byte("HTTP/1.1 200 OK")))
+	assert.True(t, bytes.HasSuffix(data, []byte("\r\n\r\nabc")))
+}
+
+func TestServeHead(t *testing.T) {
+	_, addr := startServer(t, func(w *response.Writer, req *request.Request) error {
+		w.WriteStatusLine(response.Status200)
+		if req.RequestLine.Target.Path == "/chunked" {
+			h := headers.NewHeaders()
+			h.Set("Transfer-Encoding", "chunked")
+			w.WriteHeaders(h)
+			w.Write([]byte("hello"))
+			return w.WriteChunkedBodyDone(nil)
+		}
+		w.WriteHeaders(response.GetDefaultHeaders(5))
+		_, err := w.Write([]byte("hello"))
+		return err
+	}, Config{Methods: []string{"GET", "HEAD", "POST", "OPTIONS"}})
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	head := &http.Request{Method: "HEAD"}
+
+	// Test: HEAD response keeps the headers of GET but not the body
+	_, err = conn.Write([]byte("HEAD / HTTP/1.1\r\n\r\n" +
+		"HEAD /chunked HTTP/1.1\r\n\r\n" +
+		"GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(reader, head)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Content-Length"))
+	resp, err = http.ReadResponse(reader, head)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	resp, body := readResponse(t, reader)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "hello", body)
+
+	// Test: OPTIONS * is answered by the server with the methods it supports
+	_, err = conn.Write([]byte("OPTIONS * HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	resp, body = readResponse(t, reader)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "GET, HEAD, POST, OPTIONS", resp.Header.Get("Allow"))
+	assert.Empty(t, body)
+}
+
+func TestServeMiddleware(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) error {
+				order = append(order, name+" "+req.RemoteAddr)
+				return next(w, req)
+			}
+		}
+	}
+	_, addr := startServer(t, Chain(echoHandler, mark("outer"), mark("inner")), Config{})
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: The first middleware runs first, and sees the client address
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	resp, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 200, resp.StatusCode)
+	local := conn.LocalAddr().String()
+	assert.Equal(t, []string{"outer " + local, "inner " + local}, order)
+}
+
+// lockedBuffer collects the log output of a server running in other
+// goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServeHandlerErrors(t *testing.T) {
+	var logs lockedBuffer
+	_, addr := startServer(t, func(w *response.Writer, req *request.Request) error {
+		switch req.RequestLine.Target.Path {
+		case "/missing":
+			return &HandlerError{StatusCode: response.Status404, Message: "no such user"}
+		case "/failed":
+			return errors.New("database is down")
+		case "/panic":
+			panic("handler blew up")
+		case "/late":
+			w.WriteStatusLine(response.Status200)
+			w.WriteHeaders(response.GetDefaultHeaders(10))
+			w.Write([]byte("hello"))
+			return errors.New("ran out of data")
+		}
+		return echoHandler(w, req)
+	}, Config{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: HandlerError is answered with its status and message
+	_, err = conn.Write([]byte("GET /missing HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	resp, body := readResponse(t, reader)
+	assert.Equal(t, 404, resp.StatusCode)
+	assert.Equal(t, "no such user\n", body)
+	assert.False(t, resp.Close)
+
+	// Test: Other errors are logged and answered with 500
+	_, err = conn.Write([]byte("GET /failed HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	resp, body = readResponse(t, reader)
+	assert.Equal(t, 500, resp.StatusCode)
+	assert.Equal(t, "Internal Server Error\n", body)
+	assert.Contains(t, logs.String(), "database is down")
+
+	// Test: Panic is answered with 500, logged with its stack and closes the
+	// connection
+	_, err = conn.Write([]byte("GET /panic HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	resp, _ = readResponse(t, reader)
+	assert.Equal(t, 500, resp.StatusCode)
+	assert.True(t, resp.Close)
+	assert.Contains(t, logs.String(), "handler blew up")
+	assert.Contains(t, logs.String(), "server_test.go")
+
+	// Test: Other connections are unaffected by the panic
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader = bufio.NewReader(conn)
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\nok"))
+	require.NoError(t, err)
+	resp, body = readResponse(t, reader)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "ok", body)
+
+	// Test: Error after the response started closes the connection
+	_, err = conn.Write([]byte("GET /late HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	_, err = io.ReadAll(resp.Body)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestErrorRenderers(t *testing.T) {
+	render := func(errorHandler ErrorHandler) (*http.Response, string) {
+		var out bytes.Buffer
+		w := response.NewWriter(&out)
+		errorHandler(w, response.Status404, &HandlerError{StatusCode: response.Status404, Message: "no <such> user"})
+		require.NoError(t, w.Flush())
+		return readResponse(t, bufio.NewReader(&out))
+	}
+
+	// Test: Plain text
+	resp, body := render(WriteErrorText)
+	assert.Equal(t, 404, resp.StatusCode)
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "no <such> user\n", body)
+
+	// Test: HTML escapes the message
+	resp, body = render(WriteErrorHTML)
+	assert.Equal(t, "text/html", resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, "<title>404 Not Found</title>")
+	assert.Contains(t, body, "<p>no &lt;such&gt; user</p>")
+
+	// Test: JSON
+	resp, body = render(WriteErrorJSON)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"status": 404, "error": "Not Found", "message": "no <such> user"}`, body)
+}